@@ -1,14 +1,55 @@
-const ws = new WebSocket("ws://localhost:9091/ws");
+const roomId = new URLSearchParams(window.location.search).get("room") || "default";
+// Join token issued for this room; required when the server has a JWT secret.
+const joinToken = new URLSearchParams(window.location.search).get("token");
 
+// Close code the server uses when a resume token is no longer valid.
+const closeSessionExpired = 4001;
+
+let ws = null;
+let sessionToken = null;
+let clientId = null;
 let peerConnection = null;
 let pendingIceCandidates = [];
 let pendingRemoteIceCandidates = [];
 
-ws.onopen = () => console.log("connected");
-ws.onclose = () => console.log("disconnected");
-ws.onerror = (event) => console.log("ws error:", event);
+// Signaling endpoint. The server serves this page at http://localhost:9091/,
+// which keeps the websocket same-origin. A page opened as a file falls back
+// to the local server, which then has to be started with
+// -allowed-origins null (or the origin the page is hosted on).
+const signalingUrl = window.location.protocol.startsWith("http")
+  ? `${window.location.protocol === "https:" ? "wss" : "ws"}://${window.location.host}/ws`
+  : "ws://localhost:9091/ws";
+
+// connect opens the signaling websocket. After a drop it reconnects with the
+// resume token so the server hands back the same slot and peer connection.
+function connect() {
+  let url = `${signalingUrl}?room=${encodeURIComponent(roomId)}`;
+  if (sessionToken) {
+    url += `&resume=${encodeURIComponent(sessionToken)}`;
+  } else if (joinToken) {
+    url += `&token=${encodeURIComponent(joinToken)}`;
+  }
+  ws = new WebSocket(url);
+
+  ws.onopen = () => console.log("connected");
+  ws.onerror = (event) => console.log("ws error:", event);
+  ws.onmessage = handleMessage;
+  ws.onclose = (event) => {
+    console.log("disconnected");
+    if (event.code === closeSessionExpired) {
+      console.log("session expired; reload to join again");
+      sessionToken = null;
+      return;
+    }
+    if (sessionToken) {
+      setTimeout(connect, 1000);
+    }
+  };
+}
 
-ws.onmessage = async (event) => {
+connect();
+
+async function handleMessage(event) {
   console.log(event);
 
   const message = JSON.parse(event.data);
@@ -23,31 +64,28 @@ ws.onmessage = async (event) => {
       } catch (error) {
         console.error("Failed to set remote description:", error);
       }
+      await flushPendingIceCandidates();
+      break;
 
-      for (const candidate of pendingIceCandidates) {
-        const iceMessage = {
-          type: "ice",
-          data: candidate,
-        };
-        ws.send(JSON.stringify(iceMessage));
-        console.log("ice message send from client");
-      }
-      pendingIceCandidates = [];
-      for (const remoteCandidate of pendingRemoteIceCandidates) {
-        console.log("*********************");
-        console.log(remoteCandidate);
-        console.log("*********************");
-
-        try {
-          await peerConnection.addIceCandidate(
-            new RTCIceCandidate(remoteCandidate),
-          );
-          console.log("remote ICE candidate added on answer message");
-        } catch (iceErr) {
-          console.warn("Failed to add ICE candidate:", iceErr);
-        }
+    case "offer":
+      // The server renegotiates when participants join or leave. This client
+      // is the polite peer: setRemoteDescription rolls back any offer of our
+      // own that collides with the server's.
+      console.log("processing offer");
+      try {
+        await peerConnection.setRemoteDescription(message.data);
+        await peerConnection.setLocalDescription();
+        ws.send(
+          JSON.stringify({
+            type: "answer",
+            data: peerConnection.localDescription,
+          }),
+        );
+        console.log("answer sent for server offer");
+      } catch (error) {
+        console.error("Failed to answer server offer:", error);
       }
-      pendingRemoteIceCandidates = [];
+      await flushPendingIceCandidates();
       break;
 
     case "ice":
@@ -71,11 +109,106 @@ ws.onmessage = async (event) => {
         console.log("Failed to add ICE candidate:", iceErr);
       }
       break;
+    case "session":
+      console.log(`joined as client ${message.data.id}`);
+      sessionToken = message.data.token;
+      clientId = message.data.id;
+      break;
+
+    case "muted":
+      console.log(
+        `client ${message.data.id} ${message.data.kind || "media"} muted=${message.data.muted} by ${message.data.by}`,
+      );
+      document
+        .getElementById(`client-${message.data.id}`)
+        ?.classList.toggle("muted", message.data.muted);
+      break;
+
+    case "locked":
+      console.log(`room locked=${message.data.locked} by ${message.data.by}`);
+      break;
+
+    case "recording":
+      console.log(
+        `room recording=${message.data.recording} by ${message.data.by}`,
+      );
+      break;
+
+    case "kicked":
+      console.log(`client ${message.data.id} kicked by ${message.data.by}`);
+      if (message.data.id === clientId) {
+        // Do not resume a session the moderator ended.
+        sessionToken = null;
+        peerConnection.close();
+      }
+      break;
+
+    case "error":
+      console.error(
+        `server error ${message.data.code}: ${message.data.message}`,
+      );
+      break;
+
+    case "incompatible":
+      console.warn(
+        `cannot receive ${message.data.kind} from client ${message.data.id}: ${message.data.codec} is not supported`,
+      );
+      break;
+
+    case "layers":
+      console.log(
+        `client ${message.data.id} publishes layers:`,
+        message.data.rids,
+      );
+      break;
+
+    case "joined":
+    case "ready":
+      console.log(
+        `client ${message.data.id} ${message.data.name || ""} ${message.type}`,
+      );
+      break;
+
+    case "left":
+      console.log(`client ${message.data.id} left`);
+      document.getElementById(`client-${message.data.id}`)?.remove();
+      break;
+
+    case "bandwidth":
+      // Sent when the server pauses or resumes video to this client.
+      console.log(
+        `estimated ${message.data.bandwidthEstimate} bps, video paused=${message.data.videoPaused}`,
+      );
+      break;
+
+    case "quality":
+      // Levels run from 4 (excellent) down to 0 (unusable).
+      if (message.data.id === clientId) {
+        connectionBanner.hidden = message.data.level > 1;
+      } else {
+        const tile = document.getElementById(`client-${message.data.id}`);
+        if (tile) {
+          tile.dataset.quality = message.data.level;
+          tile.title = `signal ${message.data.level}/4, rtt ${Math.round(message.data.rtt)} ms`;
+        }
+      }
+      break;
+
+    case "active-speaker":
+      console.log("active speaker:", message.data.id);
+      for (const tile of participantsEl.children) {
+        tile.classList.toggle(
+          "speaking",
+          tile.id === `client-${message.data.id}`,
+        );
+      }
+      break;
+
     default:
       console.log("undefined case");
       break;
   }
-};
+}
 
 const localCamVideoEl = document.getElementById("local-cam-video");
 const remoteCamVideoEl = document.getElementById("remote-cam-video");
@@ -84,6 +217,8 @@ const cameraSelect = document.getElementById("availableCameras");
 const startButton = document.getElementById("start");
 const remoteCamVideoSection = document.getElementById("remoteCamVideoSection");
 const audioEl = document.getElementById("audio");
+const participantsEl = document.getElementById("participants");
+const connectionBanner = document.getElementById("connectionBanner");
 
 peerConnection = new RTCPeerConnection({
   ice: [],
@@ -94,10 +229,30 @@ const audioTransceiver = peerConnection.addTransceiver("audio", {
   direction: "sendrecv",
 });
 
+// Publish three VP8 simulcast layers when the page is opened with
+// ?simulcast=1; the server picks one per viewer.
+const simulcast = new URLSearchParams(window.location.search).has("simulcast");
 const cameraTransceiver = peerConnection.addTransceiver("video", {
   direction: "sendrecv",
+  sendEncodings: simulcast
+    ? [
+        { rid: "q", scaleResolutionDownBy: 4, maxBitrate: 150000 },
+        { rid: "h", scaleResolutionDownBy: 2, maxBitrate: 500000 },
+        { rid: "f", maxBitrate: 1500000 },
+      ]
+    : undefined,
 });
 
+// The server relays chat messages between participants over this channel and
+// replays the room's recent messages when it opens.
+const chatChannel = peerConnection.createDataChannel("chat");
+chatChannel.onmessage = (event) => {
+  const { from, name, text, time } = JSON.parse(event.data);
+  console.log(
+    `[${new Date(time).toLocaleTimeString()}] ${name || `client ${from}`}: ${text}`,
+  );
+};
+
 peerConnection.onicecandidate = async (e) => {
   if (e.candidate == null) return;
   console.log("------------ice generated at client------------");
@@ -121,6 +276,19 @@ peerConnection.onconnectionstatechange = () => {
   console.log("connection state change:", peerConnection.connectionState);
 };
 
+// When the network changes ICE fails; ask the server for an offer with fresh
+// ICE credentials. If the websocket is down too, the server restarts ICE by
+// itself once we resume.
+peerConnection.oniceconnectionstatechange = () => {
+  console.log("ICE state change:", peerConnection.iceConnectionState);
+  if (
+    peerConnection.iceConnectionState === "failed" &&
+    ws.readyState === WebSocket.OPEN
+  ) {
+    ws.send(JSON.stringify({ type: "restart-ice" }));
+  }
+};
+
 peerConnection.ontrack = (e) => {
   console.log("Track received:", e.track.kind);
   console.log(e);
@@ -157,9 +325,71 @@ peerConnection.ontrack = (e) => {
       console.log(err);
     });
     console.log("camvideo stream set");
+    return;
+  }
+
+  // Every other participant's camera arrives on its own transceiver,
+  // grouped by the participant's stream.
+  if (e.track.kind === "video" && e.streams[0]) {
+    addParticipantTile(e.streams[0]);
   }
 };
 
+function addParticipantTile(stream) {
+  if (document.getElementById(stream.id)) return;
+
+  const videoEl = document.createElement("video");
+  videoEl.id = stream.id;
+  videoEl.autoplay = true;
+  videoEl.playsInline = true;
+  videoEl.muted = true;
+  videoEl.srcObject = stream;
+  participantsEl.appendChild(videoEl);
+
+  // Clicking a tile pins that participant to the main view; clicking the
+  // pinned tile again returns to the active speaker.
+  videoEl.onclick = () => {
+    const id = Number(stream.id.replace("client-", ""));
+    const pinned = videoEl.classList.toggle("pinned");
+    for (const tile of participantsEl.children) {
+      if (tile !== videoEl) tile.classList.remove("pinned");
+    }
+    ws.send(
+      JSON.stringify({
+        type: "select-source",
+        data: { id: pinned ? id : 0 },
+      }),
+    );
+  };
+
+  stream.onremovetrack = () => {
+    if (stream.getVideoTracks().length === 0) videoEl.remove();
+  };
+}
+
+async function flushPendingIceCandidates() {
+  for (const candidate of pendingIceCandidates) {
+    const iceMessage = {
+      type: "ice",
+      data: candidate,
+    };
+    ws.send(JSON.stringify(iceMessage));
+    console.log("ice message send from client");
+  }
+  pendingIceCandidates = [];
+  for (const remoteCandidate of pendingRemoteIceCandidates) {
+    try {
+      await peerConnection.addIceCandidate(
+        new RTCIceCandidate(remoteCandidate),
+      );
+      console.log("buffered remote ICE candidate added");
+    } catch (iceErr) {
+      console.warn("Failed to add ICE candidate:", iceErr);
+    }
+  }
+  pendingRemoteIceCandidates = [];
+}
+
 // Get media devices
 async function getDevices(kind) {
   const devices = await navigator.mediaDevices.enumerateDevices();
@@ -258,3 +488,20 @@ document.getElementById("start").onclick = async () => {
     alert("error");
   }
 };
+
+// Moderators send room commands from the console, for example
+// moderate("mute", { id: 2, kind: "audio", muted: true }),
+// moderate("kick", { id: 2 }), moderate("lock", { locked: true }) or
+// moderate("record", { recording: true }).
+function moderate(type, data) {
+  ws.send(JSON.stringify({ type, data }));
+}
+
+// Chat messages are sent from the console too: chat("hello").
+function chat(text) {
+  chatChannel.send(text);
+}
+
+// The page loads this file as a module, so the console helpers are exposed
+// explicitly.
+Object.assign(window, { moderate, chat });
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// speechLevel is the loudest average audio level, in -dBov, that still
+// counts as silence. Levels are 0 (loudest) to 127 (silent).
+const speechLevel = 60
+
+type levelWindow struct {
+	sum   int
+	count int
+}
+
+// ActiveSpeakerDetector picks the dominant speaker from the audio levels
+// publishers report in the ssrc-audio-level RTP header extension.
+type ActiveSpeakerDetector struct {
+	cfg SpeakerConfig
+
+	mu         sync.Mutex
+	levels     map[int]*levelWindow
+	current    int
+	lastSwitch time.Time
+}
+
+func NewActiveSpeakerDetector(cfg SpeakerConfig) *ActiveSpeakerDetector {
+	return &ActiveSpeakerDetector{
+		cfg:    cfg,
+		levels: make(map[int]*levelWindow),
+	}
+}
+
+// Observe records one audio level sample from a source. The voice activity
+// flag is not used since browsers do not set it reliably.
+func (d *ActiveSpeakerDetector) Observe(source int, level uint8) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	w, ok := d.levels[source]
+	if !ok {
+		w = &levelWindow{}
+		d.levels[source] = w
+	}
+	w.sum += int(level & 0x7F)
+	w.count++
+}
+
+// Forget drops a source that has left.
+func (d *ActiveSpeakerDetector) Forget(source int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.levels, source)
+	if d.current == source {
+		d.current = 0
+	}
+}
+
+// Current returns the dominant speaker, or 0 if there is none yet.
+func (d *ActiveSpeakerDetector) Current() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.current
+}
+
+// Evaluate closes the current interval and reports whether the dominant
+// speaker changed.
+func (d *ActiveSpeakerDetector) Evaluate(now time.Time) (int, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// Average loudness per source, in dB above silence.
+	loudness := make(map[int]float64, len(d.levels))
+	for source, w := range d.levels {
+		if w.count > 0 {
+			loudness[source] = 127 - float64(w.sum)/float64(w.count)
+		}
+		*w = levelWindow{}
+	}
+
+	best, bestLoudness := 0, 0.0
+	for source, l := range loudness {
+		if l > bestLoudness {
+			best, bestLoudness = source, l
+		}
+	}
+
+	if best == 0 || best == d.current || bestLoudness < 127-speechLevel {
+		return d.current, false
+	}
+	if d.current != 0 {
+		if bestLoudness-loudness[d.current] < d.cfg.Hysteresis {
+			return d.current, false
+		}
+		if now.Sub(d.lastSwitch) < d.cfg.MinHold {
+			return d.current, false
+		}
+	}
+
+	d.current = best
+	d.lastSwitch = now
+	return best, true
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// AdminHandler serves the admin API. It is meant for a listener of its own
+// that browsers cannot reach:
+//
+//	GET    /rooms                         rooms and their participant counts
+//	GET    /rooms/{room}                  a room with its participants
+//	GET    /rooms/{room}/participants     the participants of a room
+//	GET    /rooms/{room}/participants/{id}
+//	DELETE /rooms/{room}/participants/{id} force-disconnect a participant
+//	GET    /metrics                       Prometheus metrics
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /rooms", s.adminRooms)
+	mux.HandleFunc("GET /rooms/{room}", s.adminRoom)
+	mux.HandleFunc("GET /rooms/{room}/participants", s.adminParticipants)
+	mux.HandleFunc("GET /rooms/{room}/participants/{id}", s.adminParticipant)
+	mux.HandleFunc("DELETE /rooms/{room}/participants/{id}", s.adminDisconnect)
+	mux.Handle("GET /metrics", promhttp.Handler())
+	return mux
+}
+
+func (s *Server) adminRooms(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	rooms := make([]*Room, 0, len(s.rooms))
+	for _, room := range s.rooms {
+		rooms = append(rooms, room)
+	}
+	s.mu.Unlock()
+
+	infos := make([]RoomInfo, 0, len(rooms))
+	for _, room := range rooms {
+		infos = append(infos, room.Info(nil))
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	writeJSON(w, http.StatusOK, infos)
+}
+
+func (s *Server) adminRoom(w http.ResponseWriter, r *http.Request) {
+	room := s.adminLookupRoom(w, r)
+	if room == nil {
+		return
+	}
+	writeJSON(w, http.StatusOK, room.Info(s.resuming()))
+}
+
+func (s *Server) adminParticipants(w http.ResponseWriter, r *http.Request) {
+	room := s.adminLookupRoom(w, r)
+	if room == nil {
+		return
+	}
+	participants := room.Info(s.resuming()).Participants
+	if participants == nil {
+		participants = []ParticipantInfo{}
+	}
+	writeJSON(w, http.StatusOK, participants)
+}
+
+func (s *Server) adminParticipant(w http.ResponseWriter, r *http.Request) {
+	c := s.adminLookupClient(w, r)
+	if c == nil {
+		return
+	}
+	for _, p := range c.Room.Info(s.resuming()).Participants {
+		if p.ID == c.ID {
+			writeJSON(w, http.StatusOK, p)
+			return
+		}
+	}
+	writeJSONError(w, http.StatusNotFound, "participant not found")
+}
+
+func (s *Server) adminDisconnect(w http.ResponseWriter, r *http.Request) {
+	c := s.adminLookupClient(w, r)
+	if c == nil {
+		return
+	}
+	if err := s.disconnect(c, 0); err != nil {
+		writeJSONError(w, http.StatusConflict, err.Error())
+		return
+	}
+	log.Printf("Admin disconnected client %d from room %q\n", c.ID, c.Room.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminLookupRoom returns the room named in the request path, or writes a
+// 404 and returns nil.
+func (s *Server) adminLookupRoom(w http.ResponseWriter, r *http.Request) *Room {
+	s.mu.Lock()
+	room := s.rooms[r.PathValue("room")]
+	s.mu.Unlock()
+	if room == nil {
+		writeJSONError(w, http.StatusNotFound, "room not found")
+	}
+	return room
+}
+
+// adminLookupClient returns the participant named in the request path, or
+// writes an error and returns nil.
+func (s *Server) adminLookupClient(w http.ResponseWriter, r *http.Request) *Client {
+	room := s.adminLookupRoom(w, r)
+	if room == nil {
+		return nil
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid participant id")
+		return nil
+	}
+	room.mu.Lock()
+	c := room.clients[id]
+	room.mu.Unlock()
+	if c == nil {
+		writeJSONError(w, http.StatusNotFound, "participant not found")
+	}
+	return c
+}
+
+// resuming returns the clients whose slot is held for a resume.
+func (s *Server) resuming() map[*Client]bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	held := make(map[*Client]bool)
+	for _, sess := range s.sessions {
+		if sess.timer != nil {
+			held[sess.client] = true
+		}
+	}
+	return held
+}
+
+// Info describes the room. Its participants are listed, sorted by ID, when
+// resuming is not nil.
+func (r *Room) Info(resuming map[*Client]bool) RoomInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	info := RoomInfo{
+		ID:        r.ID,
+		Count:     len(r.clients),
+		Locked:    r.locked,
+		Recording: r.recording,
+	}
+	if r.recording {
+		info.RecordMode = r.recordMode
+	}
+	if resuming == nil {
+		return info
+	}
+
+	for _, c := range r.clients {
+		p := ParticipantInfo{
+			ID:         c.ID,
+			Name:       c.Name,
+			Role:       c.Role,
+			Ingest:     c.Ingest,
+			Egress:     c.Egress,
+			Resuming:   resuming[c],
+			AudioMuted: c.audioMuted.Load(),
+			VideoMuted: c.videoMuted.Load(),
+			Stats:      c.Stats(),
+			Published:  []TrackInfo{},
+		}
+		if c.PC != nil {
+			p.ICEState = c.PC.ICEConnectionState().String()
+			p.PeerState = c.PC.ConnectionState().String()
+			p.SignalingState = c.PC.SignalingState().String()
+		}
+		if c.subscribes() {
+			p.Audio = c.AudioSwitcher.Info()
+			p.Video = c.VideoSwitcher.Info()
+		}
+		for _, t := range r.tracks {
+			if t.Publisher == c {
+				p.Published = append(p.Published, t.Info())
+			}
+		}
+		info.Participants = append(info.Participants, p)
+	}
+	sort.Slice(info.Participants, func(i, j int) bool {
+		return info.Participants[i].ID < info.Participants[j].ID
+	})
+	return info
+}
+
+// Info describes the track.
+func (t *PublishedTrack) Info() TrackInfo {
+	t.mu.RLock()
+	subscribers := len(t.subs)
+	t.mu.RUnlock()
+
+	return TrackInfo{
+		ID:          t.Remote.ID(),
+		Kind:        t.Kind().String(),
+		RID:         t.RID,
+		Codec:       t.Remote.Codec().MimeType,
+		SSRC:        uint32(t.Remote.SSRC()),
+		Bitrate:     t.Bitrate(),
+		Subscribers: subscribers,
+	}
+}
+
+// Info tells which publisher the switcher forwards.
+func (ms *MediaSwitcher) Info() *SwitcherInfo {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	info := &SwitcherInfo{
+		Source: ms.activeIDLocked(),
+		Pinned: ms.pinned,
+	}
+	if ms.pending != nil {
+		info.Pending = ms.pending.Publisher.ID
+	}
+	return info
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("admin write error:", err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/interceptor/pkg/nack"
+	"github.com/pion/interceptor/pkg/stats"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// Send-side bandwidth estimation bounds, in bits per second.
+const (
+	initialBitrate = 1_000_000
+	minBitrate     = 30_000
+	maxBitrate     = 5_000_000
+)
+
+// newAPI builds the webrtc.API used for one PeerConnection: the configured
+// codecs, the header extensions the server reads, and an interceptor chain
+// that answers subscriber NACKs from a per-track packet history and runs
+// TWCC-based congestion control. onEstimator receives the PeerConnection's
+// bandwidth estimator when it is created, onStats the getter of its RTP
+// stream statistics.
+func newAPI(cfg Config, onEstimator func(cc.BandwidthEstimator), onStats func(stats.Getter)) (*webrtc.API, error) {
+	m := &webrtc.MediaEngine{}
+	if err := registerCodecs(m, cfg.Codecs); err != nil {
+		return nil, err
+	}
+
+	if err := m.RegisterHeaderExtension(
+		webrtc.RTPHeaderExtensionCapability{URI: sdp.AudioLevelURI},
+		webrtc.RTPCodecTypeAudio,
+	); err != nil {
+		return nil, err
+	}
+
+	ir := &interceptor.Registry{}
+
+	congestionController, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		return gcc.NewSendSideBWE(
+			gcc.SendSideBWEInitialBitrate(initialBitrate),
+			gcc.SendSideBWEMinBitrate(minBitrate),
+			gcc.SendSideBWEMaxBitrate(maxBitrate),
+			gcc.SendSideBWEPacer(gcc.NewNoOpPacer()),
+		)
+	})
+	if err != nil {
+		return nil, err
+	}
+	congestionController.OnNewPeerConnection(func(_ string, bwe cc.BandwidthEstimator) {
+		onEstimator(bwe)
+	})
+	ir.Add(congestionController)
+
+	if err := webrtc.ConfigureTWCCHeaderExtensionSender(m, ir); err != nil {
+		return nil, err
+	}
+	if err := configureNack(m, ir, cfg.NACKBufferSize); err != nil {
+		return nil, err
+	}
+	if err := webrtc.ConfigureRTCPReports(ir); err != nil {
+		return nil, err
+	}
+	if err := webrtc.ConfigureSimulcastExtensionHeaders(m); err != nil {
+		return nil, err
+	}
+	// GetStats reads its inbound-rtp stats from this interceptor.
+	if err := webrtc.ConfigureStatsInterceptor(ir); err != nil {
+		return nil, err
+	}
+	// webrtc keeps the getter above to itself, and GetStats reports nothing
+	// from the receiver reports on outbound streams, so quality sampling
+	// keeps a getter of its own.
+	statsInterceptor, err := stats.NewInterceptor()
+	if err != nil {
+		return nil, err
+	}
+	statsInterceptor.OnNewPeerConnection(func(_ string, getter stats.Getter) {
+		onStats(getter)
+	})
+	ir.Add(statsInterceptor)
+	if err := webrtc.ConfigureTWCCSender(m, ir); err != nil {
+		return nil, err
+	}
+
+	return webrtc.NewAPI(
+		webrtc.WithMediaEngine(m),
+		webrtc.WithInterceptorRegistry(ir),
+	), nil
+}
+
+// configureNack sets up NACK generation towards publishers and, when
+// bufferSize is non-zero, a responder that keeps the last bufferSize packets
+// of every outbound track and retransmits them on NACK, over RTX when the
+// subscriber negotiated it.
+func configureNack(m *webrtc.MediaEngine, ir *interceptor.Registry, bufferSize int) error {
+	generator, err := nack.NewGeneratorInterceptor()
+	if err != nil {
+		return err
+	}
+	ir.Add(generator)
+
+	if bufferSize > 0 {
+		responder, err := nack.NewResponderInterceptor(nack.ResponderSize(uint16(bufferSize)))
+		if err != nil {
+			return err
+		}
+		ir.Add(responder)
+	}
+
+	m.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack"}, webrtc.RTPCodecTypeVideo)
+	m.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack", Parameter: "pli"}, webrtc.RTPCodecTypeVideo)
+	return nil
+}
+
+// headerExtensionID returns the negotiated ID of a header extension on a
+// receiver, or 0 if it was not negotiated.
+func headerExtensionID(r *webrtc.RTPReceiver, uri string) uint8 {
+	for _, ext := range r.GetParameters().HeaderExtensions {
+		if ext.URI == uri {
+			return uint8(ext.ID)
+		}
+	}
+	return 0
+}
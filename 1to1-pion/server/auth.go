@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Role decides what a participant may do in a room.
+type Role string
+
+const (
+	// RolePublisher sends and receives media.
+	RolePublisher Role = "publisher"
+	// RoleSubscriber only receives media.
+	RoleSubscriber Role = "subscriber"
+	// RoleModerator publishes and may manage the room.
+	RoleModerator Role = "moderator"
+)
+
+func (r Role) valid() bool {
+	return r == RolePublisher || r == RoleSubscriber || r == RoleModerator
+}
+
+// CanPublish reports whether tracks from the role are accepted.
+func (r Role) CanPublish() bool {
+	return r == RolePublisher || r == RoleModerator
+}
+
+// JoinClaims are the claims of a join token. Tokens are HS256 JWTs signed
+// with the server's secret.
+type JoinClaims struct {
+	Room      string `json:"room"`
+	Name      string `json:"name"`
+	Role      Role   `json:"role"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	NotBefore int64  `json:"nbf,omitempty"`
+}
+
+var (
+	errTokenMalformed = errors.New("malformed token")
+	errTokenSignature = errors.New("invalid token signature")
+	errTokenExpired   = errors.New("token expired")
+	errTokenNotYet    = errors.New("token not valid yet")
+)
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+}
+
+var b64 = base64.RawURLEncoding
+
+// signJoinToken returns an HS256 JWT carrying the claims.
+func signJoinToken(secret []byte, claims JoinClaims) (string, error) {
+	header, err := json.Marshal(jwtHeader{Alg: "HS256", Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := b64.EncodeToString(header) + "." + b64.EncodeToString(payload)
+	return signed + "." + b64.EncodeToString(tokenMAC(secret, signed)), nil
+}
+
+// verifyJoinToken checks the token's signature and validity period and
+// returns its claims.
+func verifyJoinToken(secret []byte, token string, now time.Time) (JoinClaims, error) {
+	var claims JoinClaims
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, errTokenMalformed
+	}
+
+	rawHeader, err := b64.DecodeString(parts[0])
+	if err != nil {
+		return claims, errTokenMalformed
+	}
+	var header jwtHeader
+	if err := json.Unmarshal(rawHeader, &header); err != nil {
+		return claims, errTokenMalformed
+	}
+	// Only HS256 is accepted; the header cannot pick another algorithm.
+	if header.Alg != "HS256" {
+		return claims, fmt.Errorf("%w: unsupported alg %q", errTokenMalformed, header.Alg)
+	}
+
+	sig, err := b64.DecodeString(parts[2])
+	if err != nil {
+		return claims, errTokenMalformed
+	}
+	if !hmac.Equal(sig, tokenMAC(secret, parts[0]+"."+parts[1])) {
+		return claims, errTokenSignature
+	}
+
+	rawClaims, err := b64.DecodeString(parts[1])
+	if err != nil {
+		return claims, errTokenMalformed
+	}
+	if err := json.Unmarshal(rawClaims, &claims); err != nil {
+		return claims, errTokenMalformed
+	}
+
+	if claims.ExpiresAt != 0 && !now.Before(time.Unix(claims.ExpiresAt, 0)) {
+		return claims, errTokenExpired
+	}
+	if claims.NotBefore != 0 && now.Before(time.Unix(claims.NotBefore, 0)) {
+		return claims, errTokenNotYet
+	}
+	if claims.Room == "" || !claims.Role.valid() {
+		return claims, fmt.Errorf("%w: missing room or unknown role %q", errTokenMalformed, claims.Role)
+	}
+	return claims, nil
+}
+
+func tokenMAC(secret []byte, signed string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+	return mac.Sum(nil)
+}
+
+// bearerToken returns the join token of a websocket request. Browsers cannot
+// set headers on a websocket, so the token query parameter is accepted too.
+func bearerToken(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token
+	}
+	return r.URL.Query().Get("token")
+}
+
+// checkOrigin returns the upgrader's origin check for the allow-list. An
+// empty list keeps gorilla's default, which only accepts same-origin
+// requests such as the client served at /; "*" accepts any origin and
+// "null" a client opened as a file.
+func checkOrigin(allowed []string) func(r *http.Request) bool {
+	if len(allowed) == 0 {
+		return nil
+	}
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			// Not a browser.
+			return true
+		}
+		return slices.Contains(allowed, "*") || slices.Contains(allowed, origin)
+	}
+}
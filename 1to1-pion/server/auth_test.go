@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testSecret = []byte("test secret")
+
+// rawToken signs any header and claims with secret, so that tests can build
+// tokens signJoinToken would never produce.
+func rawToken(t *testing.T, secret []byte, header, claims any) string {
+	t.Helper()
+	h, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := b64.EncodeToString(h) + "." + b64.EncodeToString(c)
+	return signed + "." + b64.EncodeToString(tokenMAC(secret, signed))
+}
+
+func TestVerifyJoinToken(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	valid := JoinClaims{Room: "r", Name: "ann", Role: RolePublisher, ExpiresAt: now.Add(time.Hour).Unix()}
+	hs256 := jwtHeader{Alg: "HS256", Typ: "JWT"}
+
+	sign := func(claims JoinClaims) string {
+		token, err := signJoinToken(testSecret, claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	with := func(change func(*JoinClaims)) JoinClaims {
+		c := valid
+		change(&c)
+		return c
+	}
+	// tampered carries valid's signature over different claims.
+	tampered := func() string {
+		good := sign(valid)
+		other := sign(with(func(c *JoinClaims) { c.Role = RoleModerator }))
+		return other[:len(other)-len(signature(good))] + signature(good)
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		want    JoinClaims
+		wantErr error
+	}{
+		{name: "valid", token: sign(valid), want: valid},
+		{
+			name:  "valid subscriber without expiry",
+			token: sign(JoinClaims{Room: "r", Role: RoleSubscriber}),
+			want:  JoinClaims{Room: "r", Role: RoleSubscriber},
+		},
+		{name: "missing", token: "", wantErr: errTokenMalformed},
+		{name: "two parts", token: "a.b", wantErr: errTokenMalformed},
+		{name: "signed with another secret", token: rawToken(t, []byte("other"), hs256, valid), wantErr: errTokenSignature},
+		{name: "claims changed after signing", token: tampered(), wantErr: errTokenSignature},
+		{name: "signature not base64", token: sign(valid) + "!", wantErr: errTokenMalformed},
+		{name: "expired", token: sign(with(func(c *JoinClaims) { c.ExpiresAt = now.Unix() })), wantErr: errTokenExpired},
+		{name: "not valid yet", token: sign(with(func(c *JoinClaims) { c.NotBefore = now.Add(time.Minute).Unix() })), wantErr: errTokenNotYet},
+		{
+			name:    "alg none",
+			token:   b64.EncodeToString([]byte(`{"alg":"none"}`)) + "." + b64.EncodeToString([]byte(`{"room":"r","role":"publisher"}`)) + ".",
+			wantErr: errTokenMalformed,
+		},
+		{name: "alg HS512", token: rawToken(t, testSecret, jwtHeader{Alg: "HS512"}, valid), wantErr: errTokenMalformed},
+		{name: "unknown role", token: sign(with(func(c *JoinClaims) { c.Role = "admin" })), wantErr: errTokenMalformed},
+		{name: "missing room", token: sign(with(func(c *JoinClaims) { c.Room = "" })), wantErr: errTokenMalformed},
+		{name: "claims not an object", token: rawToken(t, testSecret, hs256, []string{"r"}), wantErr: errTokenMalformed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := verifyJoinToken(testSecret, tt.token, now)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("verifyJoinToken = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("verifyJoinToken = %v", err)
+			}
+			if claims != tt.want {
+				t.Errorf("claims = %+v, want %+v", claims, tt.want)
+			}
+		})
+	}
+}
+
+// signature returns the last part of a token.
+func signature(token string) string {
+	return token[strings.LastIndexByte(token, '.')+1:]
+}
+
+func TestAuthorize(t *testing.T) {
+	s := NewServer(Config{Codecs: []string{"opus", "vp8"}, JWTSecret: testSecret})
+	token, err := signJoinToken(testSecret, JoinClaims{Room: "r", Name: "bob", Role: RoleSubscriber})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		url      string
+		header   string
+		roomID   string
+		wantErr  bool
+		wantRole Role
+	}{
+		{name: "token in the header", url: "/ws", header: "Bearer " + token, roomID: "r", wantRole: RoleSubscriber},
+		{name: "token in the query", url: "/ws?token=" + token, roomID: "r", wantRole: RoleSubscriber},
+		{name: "room taken from the token", url: "/ws?token=" + token, wantRole: RoleSubscriber},
+		{name: "header wins over the query", url: "/ws?token=bad", header: "Bearer " + token, roomID: "r", wantRole: RoleSubscriber},
+		{name: "header that is not a bearer token", url: "/ws?token=" + token, header: "Basic " + token, roomID: "r", wantRole: RoleSubscriber},
+		{name: "missing token", url: "/ws", roomID: "r", wantErr: true},
+		{name: "bad token in the query", url: "/ws?token=" + token + "x", roomID: "r", wantErr: true},
+		{name: "token for another room", url: "/ws?token=" + token, roomID: "other", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.url, nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			claims, err := s.authorize(r, tt.roomID)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("authorize = %+v, want an error", claims)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("authorize = %v", err)
+			}
+			if claims.Room != "r" || claims.Role != tt.wantRole {
+				t.Errorf("claims = %+v, want room r as %s", claims, tt.wantRole)
+			}
+		})
+	}
+}
+
+func TestAuthorizeWithoutSecret(t *testing.T) {
+	s := NewServer(Config{Codecs: []string{"opus", "vp8"}})
+	claims, err := s.authorize(httptest.NewRequest("GET", "/ws", nil), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Room != defaultRoomID || claims.Role != RolePublisher {
+		t.Errorf("claims = %+v, want a publisher in %q", claims, defaultRoomID)
+	}
+}
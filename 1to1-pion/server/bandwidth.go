@@ -0,0 +1,76 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/pion/interceptor/pkg/cc"
+)
+
+// videoResumeFactor is how far above Config.MinVideoBitrate a subscriber's
+// estimate must climb before paused video is forwarded again.
+const videoResumeFactor = 1.25
+
+// watchBandwidth tracks the send-side bandwidth estimate of the client's
+// PeerConnection. It pauses video forwarding to the client while the estimate
+// is below minVideo bits per second, a minVideo of 0 never pauses, and
+// re-selects simulcast layers as the estimate moves.
+func (c *Client) watchBandwidth(bwe cc.BandwidthEstimator, minVideo int) {
+	c.bwe = bwe
+
+	bwe.OnTargetBitrateChange(func(bitrate int) {
+		if minVideo > 0 {
+			c.updateVideoPaused(bitrate, minVideo)
+		}
+
+		now := time.Now().UnixNano()
+		if last := c.lastLayerSelect.Load(); now-last >= int64(layerSelectInterval) {
+			c.lastLayerSelect.Store(now)
+			c.Room.SelectLayers(c)
+		}
+	})
+}
+
+// updateVideoPaused pauses or resumes video to the client as the estimate
+// crosses minVideo, and tells the client with its stats when it does.
+func (c *Client) updateVideoPaused(bitrate, minVideo int) {
+	paused := c.videoPaused.Load()
+	switch {
+	case !paused && bitrate < minVideo:
+		c.videoPaused.Store(true)
+		log.Printf("client %d estimate %d bps, pausing video\n", c.ID, bitrate)
+	case paused && float64(bitrate) >= float64(minVideo)*videoResumeFactor:
+		c.videoPaused.Store(false)
+		log.Printf("client %d estimate %d bps, resuming video\n", c.ID, bitrate)
+		c.Room.RequestKeyframes(c.ID)
+	default:
+		return
+	}
+	if err := c.Send("bandwidth", c.Stats()); err != nil {
+		log.Println("bandwidth write error:", err)
+	}
+}
+
+// BandwidthEstimate returns the current estimate of the bandwidth towards the
+// client in bits per second, or 0 before it is known.
+func (c *Client) BandwidthEstimate() int {
+	if c.bwe == nil {
+		return 0
+	}
+	return c.bwe.GetTargetBitrate()
+}
+
+// VideoPaused reports whether video forwarding to the client is paused for
+// lack of bandwidth.
+func (c *Client) VideoPaused() bool {
+	return c.videoPaused.Load()
+}
+
+// Stats returns a snapshot of the client's forwarding state.
+func (c *Client) Stats() ClientStats {
+	return ClientStats{
+		ID:                c.ID,
+		BandwidthEstimate: c.BandwidthEstimate(),
+		VideoPaused:       c.VideoPaused(),
+	}
+}
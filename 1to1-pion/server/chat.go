@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	// chatLabel is the label of the data channel participants chat over.
+	chatLabel = "chat"
+
+	// chatMaxLength caps the size of one chat message, in bytes.
+	chatMaxLength = 4096
+)
+
+// acceptChat takes the client's chat data channel. Each text message on it
+// is relayed to the rest of the room; once it opens, the channel is sent the
+// room's recent history.
+func (c *Client) acceptChat(dc *webrtc.DataChannel) {
+	if dc.Label() != chatLabel {
+		log.Printf("Closing data channel %q from client %d\n", dc.Label(), c.ID)
+		dc.Close()
+		return
+	}
+
+	dc.OnOpen(func() {
+		c.Room.attachChat(c, dc)
+	})
+	dc.OnClose(func() {
+		c.Room.detachChat(c, dc)
+	})
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		text := strings.TrimSpace(string(msg.Data))
+		if !msg.IsString || text == "" || len(text) > chatMaxLength {
+			return
+		}
+		c.Room.Chat(c, text)
+	})
+}
+
+// attachChat makes dc the client's chat channel and replays the history to
+// it. Both happen under the room lock, so no message is missed or delivered
+// twice in between.
+func (r *Room) attachChat(c *Client, dc *webrtc.DataChannel) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c.chat = dc
+	for _, m := range r.chat {
+		sendChat(dc, m)
+	}
+}
+
+func (r *Room) detachChat(c *Client, dc *webrtc.DataChannel) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if c.chat == dc {
+		c.chat = nil
+	}
+}
+
+// Chat stamps a message from the client and relays it to everyone else in
+// the room, keeping it in the room's history.
+func (r *Room) Chat(from *Client, text string) {
+	m := ChatMessage{
+		From: from.ID,
+		Name: from.Name,
+		Text: text,
+		Time: time.Now().UnixMilli(),
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if limit := r.cfg.ChatHistory; limit > 0 {
+		r.chat = append(r.chat, m)
+		if len(r.chat) > limit {
+			r.chat = append(r.chat[:0], r.chat[len(r.chat)-limit:]...)
+		}
+	}
+	for _, c := range r.clients {
+		if c != from && c.chat != nil {
+			sendChat(c.chat, m)
+		}
+	}
+}
+
+func sendChat(dc *webrtc.DataChannel, m ChatMessage) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		log.Println("chat marshal error:", err)
+		return
+	}
+	if err := dc.SendText(string(b)); err != nil {
+		log.Println("chat write error:", err)
+	}
+}
@@ -1,18 +1,31 @@
 package main
 
 import (
+	"encoding/json"
 	"sync"
+	"sync/atomic"
 
 	"github.com/gorilla/websocket"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/stats"
 	"github.com/pion/webrtc/v4"
 )
 
 type Client struct {
-	ID        int
-	Conn      *websocket.Conn
-	PC        *webrtc.PeerConnection
-	AudioOut  *webrtc.TrackLocalStaticRTP
-	VideoOut  *webrtc.TrackLocalStaticRTP
+	ID   int
+	Name string
+	Role Role
+	Room *Room
+	Conn *websocket.Conn
+	PC   *webrtc.PeerConnection
+	// Ingest is set for clients that only publish, such as WHIP encoders.
+	// They have no websocket and no switchers and are sent no media.
+	// Egress is set for clients that only receive the switched output,
+	// such as WHEP players; they are not sent a track per publisher.
+	Ingest   bool
+	Egress   bool
+	AudioOut *webrtc.TrackLocalStaticRTP
+	VideoOut *webrtc.TrackLocalStaticRTP
 
 	AudioSwitcher *MediaSwitcher
 	VideoSwitcher *MediaSwitcher
@@ -20,4 +33,112 @@ type Client struct {
 	clientMux sync.Mutex
 	readyOnce sync.Once
 	readyChan chan struct{}
+
+	// negMux serializes offer/answer handling so that a server offer and a
+	// client offer never interleave. negotiated is set once the client's
+	// first offer has been answered; the server does not send offers before.
+	// ignoreOffer records that the last client offer lost a collision.
+	// restartPending asks for an ICE restart once the offer in flight has
+	// been answered. offerResent records that the offer in flight was sent
+	// again after the client failed to answer it.
+	negMux         sync.Mutex
+	negotiated     bool
+	ignoreOffer    bool
+	restartPending bool
+	offerResent    bool
+
+	// iceDown is set while the media path is disconnected or failed.
+	iceDown atomic.Bool
+
+	// leaving is set under peerMu before the PeerConnection is closed.
+	// The room's loops hold peerMu for reading while they use the
+	// PeerConnection and skip a client that is leaving.
+	peerMu  sync.RWMutex
+	leaving bool
+
+	// chat is the client's open chat data channel, guarded by the room's
+	// lock.
+	chat *webrtc.DataChannel
+
+	// audioMuted and videoMuted are set by moderators.
+	audioMuted atomic.Bool
+	videoMuted atomic.Bool
+
+	// stats holds the RTP stream statistics of the PeerConnection, which
+	// quality samples.
+	stats   stats.Getter
+	quality qualitySampler
+
+	bwe             cc.BandwidthEstimator
+	videoPaused     atomic.Bool
+	lastLayerSelect atomic.Int64
+}
+
+// Send writes a signaling message to the client's websocket. Clients without
+// one are not sent anything.
+func (c *Client) Send(msgType string, data any) error {
+	msg, err := json.Marshal(MessageOut{
+		Type: msgType,
+		Data: data,
+	})
+	if err != nil {
+		return err
+	}
+
+	c.clientMux.Lock()
+	defer c.clientMux.Unlock()
+	if c.Conn == nil {
+		return nil
+	}
+	return c.Conn.WriteMessage(websocket.TextMessage, msg)
+}
+
+// subscribes reports whether the client is attached and receives media.
+func (c *Client) subscribes() bool {
+	return c.PC != nil && !c.Ingest
+}
+
+// publishes reports whether media the client sends is accepted.
+func (c *Client) publishes() bool {
+	return c.Role.CanPublish() && !c.Egress
+}
+
+// setConn replaces the websocket the client is signaled over, closing the
+// previous one.
+func (c *Client) setConn(conn *websocket.Conn) {
+	c.clientMux.Lock()
+	old := c.Conn
+	c.Conn = conn
+	c.clientMux.Unlock()
+
+	if old != nil && old != conn {
+		old.Close()
+	}
+}
+
+// closePeer marks the client as leaving and closes its PeerConnection once
+// the room's loops are done with it.
+func (c *Client) closePeer() {
+	c.peerMu.Lock()
+	c.leaving = true
+	c.peerMu.Unlock()
+	c.PC.Close()
+}
+
+// isLeaving reports whether the client's PeerConnection is being closed.
+func (c *Client) isLeaving() bool {
+	c.peerMu.RLock()
+	defer c.peerMu.RUnlock()
+	return c.leaving
+}
+
+// Close stops the goroutines that belong to the client once it has left its
+// room and its PeerConnection is closed.
+func (c *Client) Close() {
+	if c.AudioSwitcher != nil {
+		c.AudioSwitcher.Close()
+	}
+	if c.VideoSwitcher != nil {
+		c.VideoSwitcher.Close()
+	}
 }
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// mimeTypeRED is Opus wrapped in redundant audio data (RFC 2198).
+const mimeTypeRED = "audio/red"
+
+var errIncompatibleCodec = errors.New("incompatible codec")
+
+var videoFeedback = []webrtc.RTCPFeedback{
+	{Type: "goog-remb"},
+	{Type: "ccm", Parameter: "fir"},
+	{Type: "nack"},
+	{Type: "nack", Parameter: "pli"},
+}
+
+// supportedCodecs maps the names accepted by -codecs to the payload formats
+// registered for them, using pion's default payload types. Video codecs
+// carry their RTX format along.
+var supportedCodecs = map[string][]webrtc.RTPCodecParameters{
+	"opus": {
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2, SDPFmtpLine: "minptime=10;useinbandfec=1"}, PayloadType: 111},
+	},
+	"red": {
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeTypeRED, ClockRate: 48000, Channels: 2, SDPFmtpLine: "111/111"}, PayloadType: 63},
+	},
+	"vp8": {
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000, RTCPFeedback: videoFeedback}, PayloadType: 96},
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeRTX, ClockRate: 90000, SDPFmtpLine: "apt=96"}, PayloadType: 97},
+	},
+	"vp9": {
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP9, ClockRate: 90000, SDPFmtpLine: "profile-id=0", RTCPFeedback: videoFeedback}, PayloadType: 98},
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeRTX, ClockRate: 90000, SDPFmtpLine: "apt=98"}, PayloadType: 99},
+	},
+	// Constrained baseline first: it is what Safari and most hardware
+	// encoders produce.
+	"h264": {
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f", RTCPFeedback: videoFeedback}, PayloadType: 106},
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeRTX, ClockRate: 90000, SDPFmtpLine: "apt=106"}, PayloadType: 107},
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42001f", RTCPFeedback: videoFeedback}, PayloadType: 102},
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeRTX, ClockRate: 90000, SDPFmtpLine: "apt=102"}, PayloadType: 103},
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=4d001f", RTCPFeedback: videoFeedback}, PayloadType: 127},
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeRTX, ClockRate: 90000, SDPFmtpLine: "apt=127"}, PayloadType: 125},
+	},
+	"av1": {
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeAV1, ClockRate: 90000, RTCPFeedback: videoFeedback}, PayloadType: 45},
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeRTX, ClockRate: 90000, SDPFmtpLine: "apt=45"}, PayloadType: 46},
+	},
+}
+
+// codecKind returns whether the named codec carries audio or video.
+func codecKind(name string) webrtc.RTPCodecType {
+	if name == "opus" || name == "red" {
+		return webrtc.RTPCodecTypeAudio
+	}
+	return webrtc.RTPCodecTypeVideo
+}
+
+// validateCodecs checks a -codecs list: every name must be known, and there
+// must be at least one audio and one video codec. RED needs Opus, whose
+// payload type its format refers to.
+func validateCodecs(names []string) error {
+	var audio, video bool
+	for _, name := range names {
+		if _, ok := supportedCodecs[name]; !ok {
+			return fmt.Errorf("unknown codec %q", name)
+		}
+		if codecKind(name) == webrtc.RTPCodecTypeAudio {
+			audio = true
+		} else {
+			video = true
+		}
+	}
+	if !audio || !video {
+		return errors.New("need at least one audio and one video codec")
+	}
+	if slices.Contains(names, "red") && !slices.Contains(names, "opus") {
+		return errors.New("red needs opus")
+	}
+	return nil
+}
+
+// registerCodecs registers the named codecs in order of preference.
+func registerCodecs(m *webrtc.MediaEngine, names []string) error {
+	for _, name := range names {
+		for _, codec := range supportedCodecs[name] {
+			if err := m.RegisterCodec(codec, codecKind(name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// preferredCodec returns the first configured codec of a kind. The switched
+// outputs are sent in it, so only publishers that send it can be switched
+// to.
+func preferredCodec(names []string, kind webrtc.RTPCodecType) webrtc.RTPCodecCapability {
+	for _, name := range names {
+		if codecKind(name) == kind {
+			return supportedCodecs[name][0].RTPCodecCapability
+		}
+	}
+	return webrtc.RTPCodecCapability{}
+}
+
+// checkCodec reports an error when t cannot be forwarded on a track sent in
+// codec out. The server does not transcode, so the MIME types must match.
+func checkCodec(t *PublishedTrack, out webrtc.RTPCodecCapability) error {
+	if in := t.Remote.Codec().MimeType; !strings.EqualFold(in, out.MimeType) {
+		return fmt.Errorf("%w: client %d sends %s %s, the output is %s",
+			errIncompatibleCodec, t.Publisher.ID, t.Kind(), in, out.MimeType)
+	}
+	return nil
+}
+
+// receives reports whether the client offered to receive the given codec.
+// Until the client has sent a description nothing is known and every codec
+// is assumed to be received.
+func (c *Client) receives(codec webrtc.RTPCodecCapability) bool {
+	desc := c.PC.RemoteDescription()
+	if desc == nil {
+		return true
+	}
+	return codecOffered(desc.SDP, codec)
+}
+
+// codecOffered reports whether a session description lists the codec on any
+// of its media sections of the codec's kind.
+func codecOffered(raw string, codec webrtc.RTPCodecCapability) bool {
+	var desc sdp.SessionDescription
+	if err := desc.UnmarshalString(raw); err != nil {
+		return false
+	}
+	kind, name, _ := strings.Cut(codec.MimeType, "/")
+	for _, md := range desc.MediaDescriptions {
+		if md.MediaName.Media != kind {
+			continue
+		}
+		for _, attr := range md.Attributes {
+			if attr.Key != "rtpmap" {
+				continue
+			}
+			// a=rtpmap:<payload type> <encoding name>/<clock rate>[/<channels>]
+			_, encoding, _ := strings.Cut(attr.Value, " ")
+			encoding, _, _ = strings.Cut(encoding, "/")
+			if strings.EqualFold(encoding, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkOutputs reports an error when a description from the client does not
+// offer the codecs of its switched outputs for the media sections it has.
+func (c *Client) checkOutputs(raw string) error {
+	var desc sdp.SessionDescription
+	if err := desc.UnmarshalString(raw); err != nil {
+		return err
+	}
+	for _, out := range []*webrtc.TrackLocalStaticRTP{c.AudioOut, c.VideoOut} {
+		codec := out.Codec()
+		kind, _, _ := strings.Cut(codec.MimeType, "/")
+		if slices.ContainsFunc(desc.MediaDescriptions, func(md *sdp.MediaDescription) bool {
+			return md.MediaName.Media == kind
+		}) && !codecOffered(raw, codec) {
+			return fmt.Errorf("%w: the room sends %s in %s, which the client does not offer",
+				errIncompatibleCodec, kind, codec.MimeType)
+		}
+	}
+	return nil
+}
+
+// dropIncompatible unsubscribes the client from every track sent in a codec
+// its description did not offer, and tells it which tracks it is missing.
+func (r *Room) dropIncompatible(c *Client) {
+	r.mu.Lock()
+	var dropped []*PublishedTrack
+	for _, t := range r.tracks {
+		if t.hasSub(c.ID) && !c.receives(t.Remote.Codec().RTPCodecCapability) {
+			t.unsubscribe(c.ID, true)
+			dropped = append(dropped, t)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, t := range dropped {
+		log.Printf("client %d cannot receive %s from client %d\n", c.ID, t.Remote.Codec().MimeType, t.Publisher.ID)
+		c.reportIncompatible(t)
+	}
+}
+
+func (c *Client) reportIncompatible(t *PublishedTrack) {
+	if err := c.Send("incompatible", Incompatible{
+		ID:    t.Publisher.ID,
+		Kind:  t.Kind().String(),
+		Codec: t.Remote.Codec().MimeType,
+	}); err != nil {
+		log.Println("incompatible write error:", err)
+	}
+}
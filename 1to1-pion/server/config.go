@@ -0,0 +1,97 @@
+package main
+
+import (
+	"slices"
+	"time"
+)
+
+// Config holds the settings applied to every room the server creates.
+type Config struct {
+	// MaxClients caps the number of clients per room; zero means no limit.
+	MaxClients int
+
+	// NACKBufferSize is the number of packets kept per outbound track to
+	// answer NACKs from subscribers. It must be a power of two up to 32768;
+	// zero disables the buffer and NACKs are relayed to the publisher.
+	NACKBufferSize int
+
+	// MinVideoBitrate is the bandwidth estimate, in bits per second, below
+	// which video is no longer forwarded to a subscriber; zero disables it.
+	MinVideoBitrate int
+
+	// ResumeTimeout is how long a client keeps its slot after its websocket
+	// drops, waiting for a reconnect with its resume token; zero removes it
+	// immediately.
+	ResumeTimeout time.Duration
+
+	// JWTSecret verifies join tokens. When it is empty no token is needed
+	// and every client joins the room it asks for as a publisher.
+	JWTSecret []byte
+
+	// AllowedOrigins lists the origins websockets are accepted from; "*"
+	// accepts any. When empty only same-origin requests are accepted.
+	AllowedOrigins []string
+
+	// ChatHistory is how many chat messages a room keeps to replay to
+	// clients that join later; zero keeps none.
+	ChatHistory int
+
+	// Codecs lists the codecs negotiated with clients, by -codecs name and
+	// in order of preference. The first audio and video codecs are the ones
+	// the switched outputs are sent in.
+	Codecs []string
+
+	// QualityInterval is how often every client's connection quality is
+	// sampled and reported to its room; zero disables the reports.
+	QualityInterval time.Duration
+
+	Speaker SpeakerConfig
+
+	Recording RecordingConfig
+}
+
+// SpeakerConfig tunes active speaker detection.
+type SpeakerConfig struct {
+	// Interval is how often the dominant speaker is re-evaluated.
+	Interval time.Duration
+	// Hysteresis is how many dB louder than the current speaker another
+	// participant must be, on average over an interval, to take over.
+	Hysteresis float64
+	// MinHold is the minimum time between two speaker changes.
+	MinHold time.Duration
+}
+
+// RecordingConfig sets up server-side recording of published tracks.
+type RecordingConfig struct {
+	// Dir is where recordings are written, in one directory per room and
+	// participant. Recording is unavailable when it is empty.
+	Dir string
+	// Rooms lists the rooms recorded from the start; "*" records every
+	// room. Moderators can start and stop recording in any room.
+	Rooms []string
+	// Mode is how rooms are recorded from the start, and View the client
+	// whose view is recorded in RecordView mode.
+	Mode string
+	View int
+}
+
+// Recording modes.
+const (
+	// RecordTracks writes every published track to an IVF or Ogg file.
+	RecordTracks = "tracks"
+	// RecordParticipants muxes each participant's audio and video into a
+	// WebM file.
+	RecordParticipants = "participants"
+	// RecordView muxes what one client receives on its switched outputs
+	// into a WebM file.
+	RecordView = "view"
+)
+
+func validRecordMode(mode string) bool {
+	return mode == RecordTracks || mode == RecordParticipants || mode == RecordView
+}
+
+// records reports whether the room is recorded from the start.
+func (rc RecordingConfig) records(roomID string) bool {
+	return rc.Dir != "" && (slices.Contains(rc.Rooms, "*") || slices.Contains(rc.Rooms, roomID))
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// keyframeRequestInterval limits how often subscribers can make a publisher
+// send a keyframe.
+const keyframeRequestInterval = 300 * time.Millisecond
+
+// subscription is one subscriber's copy of a published track.
+type subscription struct {
+	client   *Client
+	out      *webrtc.TrackLocalStaticRTP
+	sender   *webrtc.RTPSender
+	switcher *MediaSwitcher
+	// layers feeds out from one simulcast layer at a time; nil for tracks
+	// that are not simulcast.
+	layers *MediaSwitcher
+}
+
+// PublishedTrack is a track received from one client. Every packet read from
+// it is fanned out to a dedicated TrackLocalStaticRTP on each other client in
+// the room, and to their switcher for the track's kind. Each simulcast layer
+// is a PublishedTrack of its own, grouped with its siblings.
+type PublishedTrack struct {
+	Publisher *Client
+	Remote    *webrtc.TrackRemote
+	RID       string
+
+	group *simulcastGroup
+	rate  rateMeter
+
+	// audioLevelID is the negotiated ssrc-audio-level extension ID, or 0.
+	// onAudioLevel receives every level read from it.
+	audioLevelID uint8
+	onAudioLevel func(level uint8)
+
+	mu   sync.RWMutex
+	subs map[int]*subscription
+	// recorder is set while the room is being recorded track by track,
+	// mixer while the track goes into its publisher's WebM recording.
+	recorder *TrackRecorder
+	mixer    *MixedRecorder
+
+	keyframeMu          sync.Mutex
+	lastKeyframeRequest time.Time
+
+	// srMu guards the newest sender report, which maps the track's RTP
+	// timestamps onto the publisher's wall clock.
+	srMu  sync.Mutex
+	srNTP time.Time
+	srRTP uint32
+	hasSR bool
+}
+
+func NewPublishedTrack(publisher *Client, remote *webrtc.TrackRemote) *PublishedTrack {
+	return &PublishedTrack{
+		Publisher: publisher,
+		Remote:    remote,
+		RID:       remote.RID(),
+		subs:      make(map[int]*subscription),
+	}
+}
+
+func (t *PublishedTrack) Kind() webrtc.RTPCodecType {
+	return t.Remote.Kind()
+}
+
+// Bitrate returns the track's measured bitrate in bits per second.
+func (t *PublishedTrack) Bitrate() int {
+	return t.rate.Bitrate()
+}
+
+// streamID groups all tracks of one publisher into a single MediaStream on
+// the subscriber side.
+func (t *PublishedTrack) streamID() string {
+	return fmt.Sprintf("client-%d", t.Publisher.ID)
+}
+
+// subscribe creates a local track for sub and adds it to sub's PeerConnection.
+// Simulcast layers share one local track per subscriber.
+func (t *PublishedTrack) subscribe(sub *Client) error {
+	if t.group != nil {
+		return t.group.subscribe(t, sub)
+	}
+
+	s, err := newSubscription(t, sub)
+	if err != nil {
+		return err
+	}
+	if s.sender != nil {
+		go t.readRTCP(s.sender)
+	}
+
+	t.addSub(sub.ID, s)
+	return nil
+}
+
+func newSubscription(t *PublishedTrack, sub *Client) (*subscription, error) {
+	if !sub.Egress && !sub.receives(t.Remote.Codec().RTPCodecCapability) {
+		return nil, fmt.Errorf("%w: client %d does not receive %s", errIncompatibleCodec, sub.ID, t.Remote.Codec().MimeType)
+	}
+
+	out, err := webrtc.NewTrackLocalStaticRTP(
+		t.Remote.Codec().RTPCodecCapability,
+		t.Remote.ID(),
+		t.streamID(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// Egress clients only get the switched output. Their copy of the track
+	// is never added to the PeerConnection, but still lets simulcast layers
+	// be selected for them.
+	var sender *webrtc.RTPSender
+	if !sub.Egress {
+		if sender, err = sub.PC.AddTrack(out); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &subscription{
+		client: sub,
+		out:    out,
+		sender: sender,
+	}
+	if t.Kind() == webrtc.RTPCodecTypeAudio {
+		s.switcher = sub.AudioSwitcher
+	} else {
+		s.switcher = sub.VideoSwitcher
+	}
+	// Until an active speaker is known, show the first source available.
+	if !s.switcher.HasSource() {
+		s.switcher.SwitchTo(t)
+	}
+	return s, nil
+}
+
+func (t *PublishedTrack) addSub(subID int, s *subscription) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.subs[subID] = s
+}
+
+func (t *PublishedTrack) hasSub(subID int) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	_, ok := t.subs[subID]
+	return ok
+}
+
+// unsubscribe removes sub's copy of the track. The sender is only removed
+// from the PeerConnection when removeSender is set; a closing PeerConnection
+// does not need it.
+func (t *PublishedTrack) unsubscribe(subID int, removeSender bool) {
+	t.mu.Lock()
+	s, ok := t.subs[subID]
+	delete(t.subs, subID)
+	t.mu.Unlock()
+
+	if ok && t.group != nil {
+		s = t.group.release(subID)
+		ok = s != nil
+	}
+	if !ok {
+		return
+	}
+
+	if s.layers != nil {
+		s.layers.Close()
+	}
+	if !removeSender || s.sender == nil {
+		return
+	}
+	if err := s.client.PC.RemoveTrack(s.sender); err != nil {
+		log.Println("remove track error:", err)
+	}
+}
+
+// forward reads packets from the remote track until it ends and writes each
+// of them to every subscriber.
+func (t *PublishedTrack) forward() {
+	for {
+		pkt, _, err := t.Remote.ReadRTP()
+		if err != nil {
+			log.Println("RTP read error:", err)
+			return
+		}
+		if t.Publisher.Muted(t.Kind()) {
+			continue
+		}
+		t.readAudioLevel(pkt)
+		t.rate.Add(pkt.MarshalSize())
+
+		t.mu.RLock()
+		if t.recorder != nil {
+			t.recorder.Push(pkt)
+		}
+		if t.mixer != nil {
+			t.mixer.Push(t, pkt)
+		}
+		for _, s := range t.subs {
+			if t.Kind() == webrtc.RTPCodecTypeVideo && s.client.VideoPaused() {
+				continue
+			}
+			if s.layers != nil {
+				s.layers.Push(t, pkt)
+			} else if s.sender != nil {
+				if err := s.out.WriteRTP(pkt); err == nil {
+					countForwarded(t.Kind(), pkt.MarshalSize())
+				} else if !errors.Is(err, io.ErrClosedPipe) {
+					rtpWriteErrors.WithLabelValues(t.Kind().String()).Inc()
+					log.Println("RTP write error:", err)
+				}
+			}
+			s.switcher.Push(t, pkt)
+		}
+		t.mu.RUnlock()
+	}
+}
+
+func (t *PublishedTrack) readAudioLevel(pkt *rtp.Packet) {
+	if t.audioLevelID == 0 || t.onAudioLevel == nil {
+		return
+	}
+	ext := pkt.GetExtension(t.audioLevelID)
+	if ext == nil {
+		return
+	}
+	var level rtp.AudioLevelExtension
+	if err := level.Unmarshal(ext); err != nil {
+		return
+	}
+	t.onAudioLevel(level.Level)
+}
+
+// readRTCP relays a subscriber's feedback on its copy of the track to the
+// publisher. Sequence numbers are not rewritten on this path.
+func (t *PublishedTrack) readRTCP(sender *webrtc.RTPSender) {
+	for {
+		pkts, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		t.relayFeedback(pkts, func(seq uint16) (uint16, bool) {
+			return seq, true
+		})
+	}
+}
+
+// relayFeedback forwards keyframe requests, and NACKs when the server keeps
+// no retransmission buffer, from a subscriber to the publisher, addressed to
+// the publisher's SSRC. mapSeq translates the subscriber's sequence numbers
+// into the publisher's.
+func (t *PublishedTrack) relayFeedback(pkts []rtcp.Packet, mapSeq func(uint16) (uint16, bool)) {
+	for _, pkt := range pkts {
+		switch p := pkt.(type) {
+		case *rtcp.PictureLossIndication:
+			rtcpReceived.WithLabelValues("pli").Inc()
+			t.requestKeyframe()
+
+		case *rtcp.FullIntraRequest:
+			rtcpReceived.WithLabelValues("fir").Inc()
+			t.requestKeyframe()
+
+		case *rtcp.TransportLayerNack:
+			rtcpReceived.WithLabelValues("nack").Inc()
+			// With a retransmission buffer the NACK responder has
+			// already answered from the server's own history.
+			if t.Publisher.Room.cfg.NACKBufferSize > 0 {
+				continue
+			}
+
+			var seqs []uint16
+			for _, pair := range p.Nacks {
+				for _, seq := range pair.PacketList() {
+					if sourceSeq, ok := mapSeq(seq); ok {
+						seqs = append(seqs, sourceSeq)
+					}
+				}
+			}
+			if len(seqs) == 0 {
+				continue
+			}
+
+			nack := &rtcp.TransportLayerNack{
+				MediaSSRC: uint32(t.Remote.SSRC()),
+				Nacks:     rtcp.NackPairsFromSequenceNumbers(seqs),
+			}
+			if err := t.Publisher.PC.WriteRTCP([]rtcp.Packet{nack}); err != nil {
+				log.Println("NACK write error:", err)
+				continue
+			}
+			nacksRelayed.Inc()
+		}
+	}
+}
+
+// requestKeyframe asks the publisher for a new keyframe on a video track. It
+// is rate limited so that many subscribers losing packets at once do not
+// flood the publisher.
+func (t *PublishedTrack) requestKeyframe() {
+	if t.Kind() != webrtc.RTPCodecTypeVideo {
+		return
+	}
+
+	t.keyframeMu.Lock()
+	if time.Since(t.lastKeyframeRequest) < keyframeRequestInterval {
+		t.keyframeMu.Unlock()
+		return
+	}
+	t.lastKeyframeRequest = time.Now()
+	t.keyframeMu.Unlock()
+
+	if err := sendPLI(t.Publisher.PC, t.Remote); err != nil {
+		log.Println("PLI write error:", err)
+		return
+	}
+	plisSent.Inc()
+}
+
+// readSenderReports keeps the newest sender report of the track until the
+// receiver is stopped.
+func (t *PublishedTrack) readSenderReports(r *webrtc.RTPReceiver) {
+	for {
+		var pkts []rtcp.Packet
+		var err error
+		if t.RID != "" {
+			pkts, _, err = r.ReadSimulcastRTCP(t.RID)
+		} else {
+			pkts, _, err = r.ReadRTCP()
+		}
+		if err != nil {
+			return
+		}
+
+		for _, pkt := range pkts {
+			sr, ok := pkt.(*rtcp.SenderReport)
+			if !ok || sr.SSRC != uint32(t.Remote.SSRC()) {
+				continue
+			}
+			t.srMu.Lock()
+			t.srNTP = ntpTime(sr.NTPTime)
+			t.srRTP = sr.RTPTime
+			t.hasSR = true
+			t.srMu.Unlock()
+		}
+	}
+}
+
+// senderClock converts an RTP timestamp of the track into the publisher's
+// wall-clock time. It reports false until a sender report has arrived.
+func (t *PublishedTrack) senderClock(ts uint32) (time.Time, bool) {
+	t.srMu.Lock()
+	defer t.srMu.Unlock()
+	if !t.hasSR {
+		return time.Time{}, false
+	}
+	elapsed := float64(int32(ts-t.srRTP)) / float64(t.Remote.Codec().ClockRate)
+	return t.srNTP.Add(time.Duration(elapsed * float64(time.Second))), true
+}
+
+// ntpTime converts a 64-bit NTP timestamp.
+func ntpTime(ntp uint64) time.Time {
+	const ntpEpochOffset = 2208988800 // seconds from 1900 to 1970
+	secs := int64(ntp>>32) - ntpEpochOffset
+	nanos := int64((ntp & 0xFFFFFFFF) * 1e9 >> 32)
+	return time.Unix(secs, nanos)
+}
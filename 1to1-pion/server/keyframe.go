@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+)
+
+// H264 NAL unit types that matter for keyframe detection.
+const (
+	naluTypeIDR  = 5
+	naluTypeSPS  = 7
+	naluTypeSTAP = 24
+	naluTypeFUA  = 28
+)
+
+// isKeyframeStart reports whether an RTP payload is the first packet of a
+// keyframe. Codecs that are not inspected are treated as always decodable.
+func isKeyframeStart(mimeType string, payload []byte) bool {
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP8):
+		return isVP8KeyframeStart(payload)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH264):
+		return isH264KeyframeStart(payload)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP9):
+		return isVP9KeyframeStart(payload)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeAV1):
+		return isAV1KeyframeStart(payload)
+	default:
+		return true
+	}
+}
+
+func isVP8KeyframeStart(payload []byte) bool {
+	var vp8 codecs.VP8Packet
+	frame, err := vp8.Unmarshal(payload)
+	if err != nil || len(frame) == 0 {
+		return false
+	}
+	// The P bit of the VP8 frame tag is 0 for keyframes.
+	return vp8.S == 1 && vp8.PID == 0 && frame[0]&0x01 == 0
+}
+
+func isVP9KeyframeStart(payload []byte) bool {
+	var vp9 codecs.VP9Packet
+	if _, err := vp9.Unmarshal(payload); err != nil {
+		return false
+	}
+	// A frame that is not inter-picture predicted is a keyframe.
+	return vp9.B && !vp9.P
+}
+
+func isAV1KeyframeStart(payload []byte) bool {
+	// The N bit of the aggregation header marks the first packet of a
+	// coded video sequence, which starts with a keyframe.
+	return len(payload) > 0 && payload[0]&0x08 != 0
+}
+
+func isH264KeyframeStart(payload []byte) bool {
+	if len(payload) < 2 {
+		return false
+	}
+
+	switch naluType := payload[0] & 0x1F; naluType {
+	case naluTypeIDR, naluTypeSPS:
+		return true
+	case naluTypeSTAP:
+		// Aggregation packet: 2 byte size followed by each NAL unit.
+		for i := 1; i+2 < len(payload); {
+			size := int(payload[i])<<8 | int(payload[i+1])
+			i += 2
+			if size == 0 || i+size > len(payload) {
+				return false
+			}
+			if t := payload[i] & 0x1F; t == naluTypeIDR || t == naluTypeSPS {
+				return true
+			}
+			i += size
+		}
+		return false
+	case naluTypeFUA:
+		// Fragmentation unit: start bit set on the first fragment.
+		return payload[1]&0x80 != 0 && payload[1]&0x1F == naluTypeIDR
+	default:
+		return false
+	}
+}
@@ -1,15 +1,114 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
-)
+	"os"
+	"strings"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+)
 
 func main() {
-	server := NewServer()
+	var cfg Config
+	flag.IntVar(&cfg.MaxClients, "max-clients", 3, "maximum clients per room (0 for no limit)")
+	flag.IntVar(&cfg.MinVideoBitrate, "min-video-bitrate", 150_000, "estimated bps below which video to a subscriber is paused (0 to never pause)")
+	flag.IntVar(&cfg.NACKBufferSize, "nack-buffer", 512, "packets kept per outbound track for retransmission (power of two, 0 to relay NACKs)")
+	flag.DurationVar(&cfg.ResumeTimeout, "resume-timeout", 30*time.Second, "how long a disconnected client's slot is kept for a resume (0 to drop it at once)")
+	flag.IntVar(&cfg.ChatHistory, "chat-history", 50, "chat messages replayed to clients that join later (0 for none)")
+	flag.DurationVar(&cfg.QualityInterval, "quality-interval", 2*time.Second, "how often connection quality is reported to clients (0 to disable)")
+	flag.DurationVar(&cfg.Speaker.Interval, "speaker-interval", 300*time.Millisecond, "how often the active speaker is re-evaluated (0 to disable)")
+	flag.Float64Var(&cfg.Speaker.Hysteresis, "speaker-hysteresis", 6, "dB louder than the active speaker a participant must be to take over")
+	flag.DurationVar(&cfg.Speaker.MinHold, "speaker-hold", 2*time.Second, "minimum time between active speaker changes")
+	flag.StringVar(&cfg.Recording.Dir, "record-dir", "", "directory recordings are written to (empty disables recording)")
+	recordRooms := flag.String("record-rooms", "", "comma-separated rooms recorded from the start, * for all")
+	flag.StringVar(&cfg.Recording.Mode, "record-mode", RecordTracks, "how -record-rooms are recorded: tracks, participants or view")
+	flag.IntVar(&cfg.Recording.View, "record-view", 1, "client whose view is recorded in view mode")
+	jwtSecret := flag.String("jwt-secret", os.Getenv("SFU_JWT_SECRET"), "HMAC secret verifying join tokens (default $SFU_JWT_SECRET; empty disables authentication)")
+	allowedOrigins := flag.String("allowed-origins", "", "comma-separated origins websockets are accepted from, * for any, null for a client opened as a file (default same origin only)")
+	clientDir := flag.String("client-dir", "../client", "directory the browser client is served from at / (empty to not serve it)")
+	codecs := flag.String("codecs", "opus,vp8", "comma-separated codecs to negotiate, in order of preference: opus, red, vp8, vp9, h264, av1")
+	adminAddr := flag.String("admin-addr", "localhost:9092", "address the admin API and /metrics listen on (empty to disable)")
+	mint := flag.String("mint-token", "", "print a join token for room,name,role signed with -jwt-secret and exit")
+	mintTTL := flag.Duration("mint-ttl", 24*time.Hour, "lifetime of a token printed by -mint-token")
+	flag.Parse()
+
+	cfg.JWTSecret = []byte(*jwtSecret)
+	if *recordRooms != "" {
+		cfg.Recording.Rooms = strings.Split(*recordRooms, ",")
+	}
+	if *allowedOrigins != "" {
+		cfg.AllowedOrigins = strings.Split(*allowedOrigins, ",")
+	}
+	cfg.Codecs = strings.Split(strings.ToLower(*codecs), ",")
+
+	if *mint != "" {
+		token, err := mintToken(cfg.JWTSecret, *mint, *mintTTL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(token)
+		return
+	}
+	if len(cfg.JWTSecret) == 0 {
+		log.Println("No -jwt-secret set: anyone can join any room as a publisher")
+	}
+
+	if err := validateCodecs(cfg.Codecs); err != nil {
+		log.Fatalf("invalid -codecs %q: %v", *codecs, err)
+	}
+	if !validRecordMode(cfg.Recording.Mode) {
+		log.Fatalf("invalid -record-mode %q", cfg.Recording.Mode)
+	}
+	if n := cfg.NACKBufferSize; n < 0 || n > 1<<15 || n&(n-1) != 0 {
+		log.Fatalf("invalid -nack-buffer %d: must be 0 or a power of two up to 32768", n)
+	}
+
+	server := NewServer(cfg)
+	prometheus.MustRegister(serverCollector{server})
 	http.HandleFunc("/ws", server.HandleWS)
+	http.HandleFunc("POST /whip/{room}", server.HandleWHIP)
+	http.HandleFunc("PATCH /whip/{room}/{id}", server.HandleResourcePatch)
+	http.HandleFunc("DELETE /whip/{room}/{id}", server.HandleResourceDelete)
+	http.HandleFunc("POST /whep/{room}", server.HandleWHEP)
+	http.HandleFunc("PATCH /whep/{room}/{id}", server.HandleResourcePatch)
+	http.HandleFunc("DELETE /whep/{room}/{id}", server.HandleResourceDelete)
+	if *clientDir != "" {
+		// Served from here, the client's websocket is same-origin and
+		// passes the default origin check.
+		http.Handle("/", http.FileServer(http.Dir(*clientDir)))
+	}
+	if *adminAddr != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(*adminAddr, server.AdminHandler()))
+		}()
+		log.Println("Admin API listening on", *adminAddr)
+	}
 	fmt.Println("Server started")
 	log.Fatal(http.ListenAndServe(":9091", nil))
 }
+
+// mintToken signs a join token for a "room,name,role" spec.
+func mintToken(secret []byte, spec string, ttl time.Duration) (string, error) {
+	if len(secret) == 0 {
+		return "", errors.New("-mint-token needs -jwt-secret")
+	}
+	fields := strings.Split(spec, ",")
+	if len(fields) != 3 {
+		return "", fmt.Errorf("-mint-token %q: want room,name,role", spec)
+	}
+	claims := JoinClaims{
+		Room:      fields[0],
+		Name:      fields[1],
+		Role:      Role(fields[2]),
+		ExpiresAt: time.Now().Add(ttl).Unix(),
+	}
+	if !claims.Role.valid() {
+		return "", fmt.Errorf("-mint-token: unknown role %q", claims.Role)
+	}
+	return signJoinToken(secret, claims)
+}
@@ -2,59 +2,351 @@ package main
 
 import (
 	"errors"
-	"fmt"
 	"io"
+	"log"
+	"sync"
+	"time"
 
 	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v4"
 )
 
+// keyframeRetryInterval is how long a video switcher waits for a keyframe
+// from a new source before asking for one again.
+const keyframeRetryInterval = 500 * time.Millisecond
+
+// switchedPacket is a packet queued for a switcher together with the source
+// it came from.
+type switchedPacket struct {
+	source  *PublishedTrack
+	arrival time.Time
+	pkt     *rtp.Packet
+}
+
+// MediaSwitcher forwards one source at a time to an outbound track. Video
+// switches are deferred: the current source keeps flowing until the pending
+// one delivers a keyframe, and the cut happens on that frame.
 type MediaSwitcher struct {
-	outTrack     *webrtc.TrackLocalStaticRTP
-	packetChan   chan *rtp.Packet
-	activeSource int
+	outTrack   *webrtc.TrackLocalStaticRTP
+	packetChan chan switchedPacket
+	rewriter   *RTPRewriter
+
+	closeOnce sync.Once
+	done      chan struct{}
+	// switching wakes the writer when a video switch starts, so that it
+	// keeps asking for a keyframe until the switch is over.
+	switching chan struct{}
+
+	mu      sync.Mutex
+	pinned  bool
+	active  *PublishedTrack
+	pending *PublishedTrack
+	lastPLI time.Time
+	// recorder receives every packet the switcher forwards.
+	recorder *MixedRecorder
 }
 
 func NewMediaSwitcher(outTrack *webrtc.TrackLocalStaticRTP) *MediaSwitcher {
 	ms := &MediaSwitcher{
 		outTrack:   outTrack,
-		packetChan: make(chan *rtp.Packet, 100),
+		packetChan: make(chan switchedPacket, 100),
+		rewriter:   NewRTPRewriter(),
+		done:       make(chan struct{}),
+		switching:  make(chan struct{}, 1),
 	}
 	go ms.writer()
 	return ms
 }
 
+// Close stops the switcher's writer. Packets pushed afterwards are dropped.
+func (ms *MediaSwitcher) Close() {
+	ms.closeOnce.Do(func() {
+		close(ms.done)
+	})
+}
+
+// ActiveSource returns the ID of the client being forwarded, or 0.
+func (ms *MediaSwitcher) ActiveSource() int {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.active == nil {
+		return 0
+	}
+	return ms.active.Publisher.ID
+}
+
+// HasSource reports whether the switcher has an active or pending source.
+func (ms *MediaSwitcher) HasSource() bool {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.active != nil || ms.pending != nil
+}
+
+// Target returns the source the switcher is switching to, or the active one
+// when no switch is pending.
+func (ms *MediaSwitcher) Target() *PublishedTrack {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.pending != nil {
+		return ms.pending
+	}
+	return ms.active
+}
+
+// Push queues a packet from the given source. Packets from sources other than
+// the active or pending one are ignored, and so are packets that find the
+// queue full: a subscriber that falls behind must not hold up the publisher's
+// other subscribers.
+func (ms *MediaSwitcher) Push(source *PublishedTrack, pkt *rtp.Packet) {
+	ms.mu.Lock()
+	wanted := source == ms.active || source == ms.pending
+	ms.mu.Unlock()
+	if !wanted {
+		return
+	}
+
+	select {
+	case ms.packetChan <- switchedPacket{
+		source:  source,
+		arrival: time.Now(),
+		pkt:     pkt.Clone(),
+	}:
+	case <-ms.done:
+	default:
+		switcherDrops.WithLabelValues(ms.outTrack.Kind().String()).Inc()
+	}
+}
+
+// accept decides whether a queued packet is written, completing a pending
+// switch when the new source's keyframe arrives.
+func (ms *MediaSwitcher) accept(sp switchedPacket) bool {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if ms.pending != nil && sp.source == ms.pending {
+		if isKeyframeStart(sp.source.Remote.Codec().MimeType, sp.pkt.Payload) {
+			log.Printf("switched from source %d to %d on keyframe\n", ms.activeIDLocked(), sp.source.Publisher.ID)
+			ms.active = sp.source
+			ms.pending = nil
+			switches.WithLabelValues(sp.source.Kind().String()).Inc()
+			return true
+		}
+		return false
+	}
+
+	// Packets still queued from a previous source are dropped.
+	return sp.source == ms.active
+}
+
+// retryKeyframe asks the pending source for a keyframe again if the last
+// request has gone unanswered for keyframeRetryInterval. It reports false
+// once no switch is pending.
+func (ms *MediaSwitcher) retryKeyframe() bool {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.pending == nil {
+		return false
+	}
+	if time.Since(ms.lastPLI) >= keyframeRetryInterval {
+		ms.requestKeyframeLocked()
+	}
+	return true
+}
+
 func (ms *MediaSwitcher) writer() {
-	var currTimestamp uint32
-	for i := uint16(0); ; i++ {
-		packet := <-ms.packetChan
-		currTimestamp = currTimestamp + packet.Timestamp
-		packet.Timestamp = currTimestamp
-		packet.SequenceNumber = i
-		if err := ms.outTrack.WriteRTP(packet); err != nil {
-			fmt.Println(err)
-			if errors.Is(err, io.ErrClosedPipe) {
-				fmt.Println("pipe closed;write failed")
-				return
+	// retry ticks while a video switch is pending, whether or not the
+	// pending source is sending.
+	var retry *time.Ticker
+	var retryC <-chan time.Time
+	stopRetry := func() {
+		if retry != nil {
+			retry.Stop()
+			retry, retryC = nil, nil
+		}
+	}
+	defer stopRetry()
+
+	for {
+		var sp switchedPacket
+		select {
+		case <-ms.done:
+			return
+		case <-ms.switching:
+			if retry == nil {
+				retry = time.NewTicker(keyframeRetryInterval / 2)
+				retryC = retry.C
 			}
+			continue
+		case <-retryC:
+			if !ms.retryKeyframe() {
+				stopRetry()
+			}
+			continue
+		case sp = <-ms.packetChan:
+		}
+
+		if !ms.accept(sp) {
+			continue
+		}
+		if rec := ms.Recorder(); rec != nil {
+			rec.Push(sp.source, sp.pkt)
+		}
+		clockRate := sp.source.Remote.Codec().ClockRate
+		if !ms.rewriter.Rewrite(sp.source, clockRate, sp.pkt, sp.arrival) {
+			continue
+		}
+		if err := ms.outTrack.WriteRTP(sp.pkt); err == nil {
+			countForwarded(ms.outTrack.Kind(), sp.pkt.MarshalSize())
+		} else if errors.Is(err, io.ErrClosedPipe) {
+			return
+		} else {
+			rtpWriteErrors.WithLabelValues(ms.outTrack.Kind().String()).Inc()
+			log.Println("RTP write error:", err)
+		}
+	}
+}
+
+// SetRecorder makes the switcher feed its output into rec, or stops doing so
+// when rec is nil.
+func (ms *MediaSwitcher) SetRecorder(rec *MixedRecorder) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.recorder = rec
+}
+
+// Recorder returns the recording the switcher feeds, if any.
+func (ms *MediaSwitcher) Recorder() *MixedRecorder {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.recorder
+}
+
+// readRTCP relays the subscriber's feedback on the switched track to
+// whichever source is active, mapping sequence numbers back through the
+// rewriter.
+func (ms *MediaSwitcher) readRTCP(sender *webrtc.RTPSender) {
+	for {
+		pkts, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+
+		ms.mu.Lock()
+		active := ms.active
+		ms.mu.Unlock()
+		if active == nil {
+			continue
 		}
+
+		active.relayFeedback(pkts, func(seq uint16) (uint16, bool) {
+			source, sourceSeq, ok := ms.rewriter.SourceSeq(seq)
+			return sourceSeq, ok && source == active
+		})
 	}
 }
 
-func (ms *MediaSwitcher) SwitchTo(sourceID int, pc *webrtc.PeerConnection, tr *webrtc.TrackRemote) {
-	fmt.Println("switchto func")
-	if ms.activeSource == sourceID {
+// SwitchTo makes t the forwarded source. Audio switches immediately; video
+// keeps the current source until t delivers a keyframe, requesting one from
+// its publisher.
+func (ms *MediaSwitcher) SwitchTo(t *PublishedTrack) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.switchToLocked(t)
+}
+
+// Follow switches like SwitchTo unless the switcher is pinned. It is used
+// for automatic switching.
+func (ms *MediaSwitcher) Follow(t *PublishedTrack) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.pinned {
 		return
 	}
+	ms.switchToLocked(t)
+}
 
-	ms.activeSource = sourceID
+// Pin switches to t and keeps it there until Unpin is called.
+func (ms *MediaSwitcher) Pin(t *PublishedTrack) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.pinned = true
+	ms.switchToLocked(t)
+}
 
-	if tr.Kind() == webrtc.RTPCodecTypeVideo {
-		_ = pc.WriteRTCP([]rtcp.Packet{
-			&rtcp.PictureLossIndication{
-				MediaSSRC: uint32(tr.SSRC()),
-			},
-		})
+// Unpin hands the switcher back to automatic switching.
+func (ms *MediaSwitcher) Unpin() {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.pinned = false
+}
+
+func (ms *MediaSwitcher) switchToLocked(t *PublishedTrack) {
+	if err := checkCodec(t, ms.outTrack.Codec()); err != nil {
+		log.Println("switch refused:", err)
+		return
+	}
+	if ms.active == t {
+		ms.pending = nil
+		return
 	}
+	if ms.pending == t {
+		return
+	}
+
+	if t.Kind() != webrtc.RTPCodecTypeVideo {
+		ms.active = t
+		switches.WithLabelValues(t.Kind().String()).Inc()
+		return
+	}
+
+	ms.pending = t
+	ms.requestKeyframeLocked()
+	select {
+	case ms.switching <- struct{}{}:
+	default:
+	}
+}
+
+// Drop stops forwarding the given publisher's tracks, which are going away,
+// and unpins the switcher if it was pinned to them. It reports whether the
+// switcher was showing or switching to that publisher.
+func (ms *MediaSwitcher) Drop(publisherID int) bool {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	dropped := false
+	if ms.pending != nil && ms.pending.Publisher.ID == publisherID {
+		ms.pending = nil
+		dropped = true
+	}
+	if ms.active != nil && ms.active.Publisher.ID == publisherID {
+		ms.active = nil
+		dropped = true
+	}
+	if dropped {
+		ms.pinned = false
+	}
+	return dropped
+}
+
+func (ms *MediaSwitcher) activeIDLocked() int {
+	if ms.active == nil {
+		return 0
+	}
+	return ms.active.Publisher.ID
+}
+
+func (ms *MediaSwitcher) requestKeyframeLocked() {
+	ms.lastPLI = time.Now()
+	ms.pending.requestKeyframe()
+}
+
+// sendPLI asks the sender of tr for a keyframe over its PeerConnection.
+func sendPLI(pc *webrtc.PeerConnection, tr *webrtc.TrackRemote) error {
+	return pc.WriteRTCP([]rtcp.Packet{
+		&rtcp.PictureLossIndication{
+			MediaSSRC: uint32(tr.SSRC()),
+		},
+	})
 }
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"github.com/pion/webrtc/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Counters updated on the media path. Kind labels are "audio" or "video".
+var (
+	forwardedPackets = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sfu_forwarded_packets_total",
+		Help: "RTP packets written to subscribers.",
+	}, []string{"kind"})
+	forwardedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sfu_forwarded_bytes_total",
+		Help: "RTP bytes, headers included, written to subscribers.",
+	}, []string{"kind"})
+	rtpWriteErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sfu_rtp_write_errors_total",
+		Help: "RTP packets that could not be written to a subscriber.",
+	}, []string{"kind"})
+
+	switches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sfu_switches_total",
+		Help: "Changes of the source a switched output forwards.",
+	}, []string{"kind"})
+	switcherDrops = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sfu_switcher_dropped_packets_total",
+		Help: "Packets dropped because a switcher's queue was full.",
+	}, []string{"kind"})
+	recorderDrops = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sfu_recorder_dropped_packets_total",
+		Help: "Packets dropped because a recorder's queue was full.",
+	}, []string{"kind"})
+
+	rtcpReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sfu_rtcp_received_total",
+		Help: "Feedback received from subscribers, by type: pli, fir or nack.",
+	}, []string{"type"})
+	plisSent = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sfu_pli_sent_total",
+		Help: "Keyframe requests sent to publishers.",
+	})
+	nacksRelayed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sfu_nack_relayed_total",
+		Help: "Subscriber NACKs relayed to publishers when no retransmission buffer is kept.",
+	})
+
+	iceTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sfu_ice_state_transitions_total",
+		Help: "ICE connection state changes, by the state entered.",
+	}, []string{"state"})
+)
+
+// countForwarded records a packet of size bytes written to a subscriber.
+func countForwarded(kind webrtc.RTPCodecType, size int) {
+	forwardedPackets.WithLabelValues(kind.String()).Inc()
+	forwardedBytes.WithLabelValues(kind.String()).Add(float64(size))
+}
+
+var (
+	roomsDesc = prometheus.NewDesc(
+		"sfu_rooms", "Open rooms.", nil, nil)
+	participantsDesc = prometheus.NewDesc(
+		"sfu_participants", "Clients in a room, including those held for a resume.", nil, nil)
+	queueDepthDesc = prometheus.NewDesc(
+		"sfu_switcher_queue_depth_max", "Packets queued in the fullest switcher.", []string{"kind"}, nil)
+)
+
+// serverCollector reports the server's rooms and participants and how far
+// the switchers have fallen behind, read at scrape time.
+type serverCollector struct {
+	s *Server
+}
+
+func (sc serverCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- roomsDesc
+	ch <- participantsDesc
+	ch <- queueDepthDesc
+}
+
+func (sc serverCollector) Collect(ch chan<- prometheus.Metric) {
+	sc.s.mu.Lock()
+	rooms := make([]*Room, 0, len(sc.s.rooms))
+	for _, room := range sc.s.rooms {
+		rooms = append(rooms, room)
+	}
+	sc.s.mu.Unlock()
+
+	participants, audioDepth, videoDepth := 0, 0, 0
+	for _, room := range rooms {
+		room.mu.Lock()
+		participants += len(room.clients)
+		for _, c := range room.clients {
+			if !c.subscribes() {
+				continue
+			}
+			audioDepth = max(audioDepth, len(c.AudioSwitcher.packetChan))
+			videoDepth = max(videoDepth, len(c.VideoSwitcher.packetChan))
+		}
+		room.mu.Unlock()
+	}
+
+	ch <- prometheus.MustNewConstMetric(roomsDesc, prometheus.GaugeValue, float64(len(rooms)))
+	ch <- prometheus.MustNewConstMetric(participantsDesc, prometheus.GaugeValue, float64(participants))
+	ch <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, float64(audioDepth), "audio")
+	ch <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, float64(videoDepth), "video")
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+	"github.com/pion/webrtc/v4/pkg/media/samplebuilder"
+)
+
+// WebM track numbers of a mixed recording.
+const (
+	mixedVideoTrack = 1
+	mixedAudioTrack = 2
+)
+
+// mixedPacket is a packet queued for a MixedRecorder together with the track
+// it came from.
+type mixedPacket struct {
+	source *PublishedTrack
+	pkt    *rtp.Packet
+}
+
+// mixedInput assembles the frames of the source currently feeding one track
+// of the recording.
+type mixedInput struct {
+	source  *PublishedTrack
+	builder *samplebuilder.SampleBuilder
+	// last is the timestamp of the last block written, in milliseconds.
+	last int64
+}
+
+// MixedRecorder muxes an audio and a video stream into one WebM file. Both
+// streams may change source over time, as a switched output does. Every
+// frame is placed by its publisher's RTCP sender reports, so audio and video
+// stay in sync; frames that arrive before a source's first sender report are
+// dropped.
+type MixedRecorder struct {
+	path string
+	webm *webmWriter
+	// origin is the wall-clock time of the first video keyframe, which
+	// opens the file.
+	origin time.Time
+
+	audio, video mixedInput
+	needKeyframe bool
+
+	packetChan chan mixedPacket
+	closeOnce  sync.Once
+	done       chan struct{}
+	stopped    chan struct{}
+}
+
+// NewMixedRecorder starts a recording that is written to path once video
+// arrives.
+func NewMixedRecorder(path string) (*MixedRecorder, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+
+	m := &MixedRecorder{
+		path:         path,
+		audio:        mixedInput{last: -1},
+		video:        mixedInput{last: -1},
+		needKeyframe: true,
+		packetChan:   make(chan mixedPacket, 100),
+		done:         make(chan struct{}),
+		stopped:      make(chan struct{}),
+	}
+	log.Println("mixed recording to", path)
+	go m.run()
+	return m, nil
+}
+
+// Push queues a packet from source. Like TrackRecorder.Push, it drops the
+// packet when the queue is full.
+func (m *MixedRecorder) Push(source *PublishedTrack, pkt *rtp.Packet) {
+	select {
+	case m.packetChan <- mixedPacket{source: source, pkt: pkt.Clone()}:
+	case <-m.done:
+	default:
+		recorderDrops.WithLabelValues(source.Kind().String()).Inc()
+	}
+}
+
+// Close writes out what is still buffered and closes the file.
+func (m *MixedRecorder) Close() {
+	m.closeOnce.Do(func() {
+		close(m.done)
+	})
+	<-m.stopped
+}
+
+func (m *MixedRecorder) run() {
+	defer close(m.stopped)
+
+	for {
+		select {
+		case <-m.done:
+			for _, in := range []*mixedInput{&m.video, &m.audio} {
+				if in.builder != nil {
+					in.builder.Flush()
+					m.popSamples(in)
+				}
+			}
+			if m.webm == nil {
+				log.Println("mixed recording got no video, nothing written:", m.path)
+				return
+			}
+			if err := m.webm.Close(); err != nil {
+				log.Println("mixed recording close error:", err)
+			}
+			log.Println("mixed recording finished:", m.path)
+			return
+
+		case mp := <-m.packetChan:
+			in := m.input(mp.source)
+			if in == nil {
+				continue
+			}
+			in.builder.Push(mp.pkt)
+			m.popSamples(in)
+		}
+	}
+}
+
+// input returns the input for the source's kind, switching it over to source
+// if it was fed by another track. It returns nil for codecs that cannot be
+// recorded.
+func (m *MixedRecorder) input(source *PublishedTrack) *mixedInput {
+	in := &m.audio
+	if source.Kind() == webrtc.RTPCodecTypeVideo {
+		in = &m.video
+	}
+	if in.source == source {
+		return in
+	}
+
+	codec := source.Remote.Codec()
+	var depacketizer rtp.Depacketizer
+	switch {
+	case in == &m.video && strings.EqualFold(codec.MimeType, webrtc.MimeTypeVP8):
+		depacketizer = &codecs.VP8Packet{}
+	case in == &m.audio && strings.EqualFold(codec.MimeType, webrtc.MimeTypeOpus):
+		depacketizer = &codecs.OpusPacket{}
+	default:
+		return nil
+	}
+
+	// Sequence numbers of the new source are unrelated to the old one's,
+	// so it gets a sample builder of its own.
+	in.source = source
+	in.builder = samplebuilder.New(recordMaxLate, depacketizer, codec.ClockRate)
+	if in == &m.video {
+		m.needKeyframe = true
+	}
+	return in
+}
+
+func (m *MixedRecorder) popSamples(in *mixedInput) {
+	for sample := in.builder.Pop(); sample != nil; sample = in.builder.Pop() {
+		if err := m.writeSample(in, sample); err != nil {
+			log.Println("mixed recording write error:", err)
+		}
+	}
+}
+
+func (m *MixedRecorder) writeSample(in *mixedInput, sample *media.Sample) error {
+	at, ok := in.source.senderClock(sample.PacketTimestamp)
+	if !ok {
+		return nil
+	}
+
+	track := uint64(mixedAudioTrack)
+	keyframe := true
+	if in == &m.video {
+		track = mixedVideoTrack
+		keyframe = len(sample.Data) > 0 && sample.Data[0]&0x01 == 0
+		if sample.PrevDroppedPackets > 0 {
+			m.needKeyframe = true
+		}
+		if m.needKeyframe {
+			if !keyframe {
+				in.source.requestKeyframe()
+				return nil
+			}
+			m.needKeyframe = false
+		}
+		if m.webm == nil {
+			if err := m.open(sample.Data, at); err != nil {
+				return err
+			}
+		}
+	}
+	if m.webm == nil {
+		return nil
+	}
+
+	ts := at.Sub(m.origin).Milliseconds()
+	if ts < 0 {
+		return nil
+	}
+	// Publishers' clocks disagree, so a switch of source may step back in
+	// time; blocks of a track must not.
+	if ts <= in.last {
+		ts = in.last + 1
+	}
+	in.last = ts
+	return m.webm.WriteBlock(track, keyframe, ts, sample.Data)
+}
+
+// open creates the file on the first video keyframe, which gives the
+// picture size.
+func (m *MixedRecorder) open(keyframe []byte, at time.Time) error {
+	width, height := vp8Size(keyframe)
+
+	f, err := os.Create(m.path)
+	if err != nil {
+		return err
+	}
+	w, err := newWebMWriter(f, []webmTrack{
+		{
+			Number:  mixedVideoTrack,
+			Video:   true,
+			CodecID: "V_VP8",
+			Width:   width,
+			Height:  height,
+		},
+		{
+			Number:       mixedAudioTrack,
+			CodecID:      "A_OPUS",
+			CodecPrivate: opusHead(2, 48000),
+			SampleRate:   48000,
+			Channels:     2,
+		},
+	})
+	if err != nil {
+		f.Close()
+		return err
+	}
+	m.webm = w
+	m.origin = at
+	return nil
+}
+
+// vp8Size reads the picture size from a VP8 keyframe, falling back to VGA
+// when the header cannot be read.
+func vp8Size(frame []byte) (width, height int) {
+	if len(frame) < 10 || frame[3] != 0x9d || frame[4] != 0x01 || frame[5] != 0x2a {
+		return 640, 480
+	}
+	width = int(binary.LittleEndian.Uint16(frame[6:8]) & 0x3fff)
+	height = int(binary.LittleEndian.Uint16(frame[8:10]) & 0x3fff)
+	return width, height
+}
+
+// setMixer feeds the track into a mixed recording, or stops doing so when m
+// is nil.
+func (t *PublishedTrack) setMixer(m *MixedRecorder) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.mixer = m
+}
+
+func (t *PublishedTrack) hasMixer() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.mixer != nil
+}
+
+// startRecordingLocked starts recording the room in its recording mode.
+// Tracks published later are added by recordTrackLocked and, in view mode,
+// a view client that has not attached yet by recordClientLocked.
+func (r *Room) startRecordingLocked() {
+	if r.recordMode == RecordView {
+		if c, ok := r.clients[r.recordView]; ok {
+			r.recordClientLocked(c)
+		}
+		return
+	}
+	for _, t := range r.tracks {
+		r.recordTrackLocked(t)
+	}
+}
+
+// recordTrackLocked adds a published track to the room's recording.
+func (r *Room) recordTrackLocked(t *PublishedTrack) {
+	switch r.recordMode {
+	case RecordTracks:
+		if err := t.startRecording(r.recordDir(t.Publisher.ID)); err != nil {
+			log.Printf("record client %d %s failed: %v\n", t.Publisher.ID, t.Kind(), err)
+		}
+
+	case RecordParticipants:
+		// Only one track of each kind, which for simulcast means a
+		// single layer, goes into a participant's file.
+		for _, other := range r.tracks {
+			if other != t && other.Publisher == t.Publisher && other.Kind() == t.Kind() && other.hasMixer() {
+				return
+			}
+		}
+		m, ok := r.mixers[t.Publisher.ID]
+		if !ok {
+			var err error
+			m, err = NewMixedRecorder(r.mixedPath(t.Publisher.ID, "participant"))
+			if err != nil {
+				log.Printf("record client %d failed: %v\n", t.Publisher.ID, err)
+				return
+			}
+			r.mixers[t.Publisher.ID] = m
+		}
+		t.setMixer(m)
+	}
+}
+
+// recordClientLocked starts recording what c sees when c is the client the
+// room's view recording follows.
+func (r *Room) recordClientLocked(c *Client) {
+	if r.recordMode != RecordView || c.ID != r.recordView || !c.subscribes() {
+		return
+	}
+	if _, ok := r.mixers[c.ID]; ok {
+		return
+	}
+
+	m, err := NewMixedRecorder(r.mixedPath(c.ID, "view"))
+	if err != nil {
+		log.Printf("record view of client %d failed: %v\n", c.ID, err)
+		return
+	}
+	r.mixers[c.ID] = m
+	c.AudioSwitcher.SetRecorder(m)
+	c.VideoSwitcher.SetRecorder(m)
+}
+
+// stopRecordingLocked stops every recording in the room and returns the
+// recorders for the caller to close.
+func (r *Room) stopRecordingLocked() []recorderCloser {
+	var recs []recorderCloser
+	for _, t := range r.tracks {
+		if rec := t.detachRecorder(); rec != nil {
+			recs = append(recs, rec)
+		}
+		t.setMixer(nil)
+	}
+	for _, c := range r.clients {
+		if c.subscribes() {
+			c.AudioSwitcher.SetRecorder(nil)
+			c.VideoSwitcher.SetRecorder(nil)
+		}
+	}
+	for id, m := range r.mixers {
+		recs = append(recs, m)
+		delete(r.mixers, id)
+	}
+	return recs
+}
+
+// detachMixerLocked removes the mixed recording of a client that left and
+// returns it, or nil, for the caller to close.
+func (r *Room) detachMixerLocked(id int) *MixedRecorder {
+	m, ok := r.mixers[id]
+	if !ok {
+		return nil
+	}
+	delete(r.mixers, id)
+	return m
+}
+
+// mixedPath is the file a mixed recording of the given client is written to.
+func (r *Room) mixedPath(id int, kind string) string {
+	name := fmt.Sprintf("%s-%s.webm", kind, time.Now().Format("20060102-150405"))
+	return filepath.Join(r.recordDir(id), name)
+}
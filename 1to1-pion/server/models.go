@@ -11,3 +11,182 @@ type MessageOut struct {
 	Type string      `json:"type"`
 	Data any `json:"data"`
 }
+
+// SelectSource is the data of a "select-source" message. An ID of 0 unpins
+// the selection; an empty Kind applies to both audio and video.
+type SelectSource struct {
+	ID   int    `json:"id"`
+	Kind string `json:"kind,omitempty"`
+}
+
+// ClientStats is a snapshot of one client's forwarding state, sent to the
+// client as the "bandwidth" message when its video is paused or resumed.
+type ClientStats struct {
+	ID int `json:"id"`
+	// BandwidthEstimate is the estimated bandwidth towards the client in
+	// bits per second.
+	BandwidthEstimate int  `json:"bandwidthEstimate"`
+	VideoPaused       bool `json:"videoPaused"`
+}
+
+// LayersInfo announces the simulcast layers of a published track.
+type LayersInfo struct {
+	ID      int      `json:"id"`
+	TrackID string   `json:"trackId"`
+	RIDs    []string `json:"rids"`
+}
+
+// SetLayer is the data of a "set-layer" message. An empty RID returns to
+// bandwidth-based layer selection.
+type SetLayer struct {
+	ID  int    `json:"id"`
+	RID string `json:"rid"`
+}
+
+// Participant identifies the client a lifecycle or speaker event is about.
+type Participant struct {
+	ID   int    `json:"id"`
+	Name string `json:"name,omitempty"`
+}
+
+// Session tells a client its ID and the token that lets a new websocket take
+// over its slot after a disconnect.
+type Session struct {
+	ID    int    `json:"id"`
+	Token string `json:"token"`
+}
+
+// ErrorMessage reports a signaling message the server could not handle.
+type ErrorMessage struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Mute is a moderator's request to mute or unmute a participant's "audio",
+// "video", or both when Kind is empty. It is broadcast as the "muted" event
+// with By set to the moderator.
+type Mute struct {
+	ID    int    `json:"id"`
+	Kind  string `json:"kind,omitempty"`
+	Muted bool   `json:"muted"`
+	By    int    `json:"by,omitempty"`
+}
+
+// Kick is a moderator's request to remove a participant, broadcast as the
+// "kicked" event.
+type Kick struct {
+	ID int `json:"id"`
+	By int `json:"by,omitempty"`
+}
+
+// Lock is a moderator's request to lock or unlock the room, broadcast as the
+// "locked" event.
+type Lock struct {
+	Locked bool `json:"locked"`
+	By     int  `json:"by,omitempty"`
+}
+
+// Record is a moderator's request to start or stop recording the room,
+// broadcast as the "recording" event. Mode is one of "tracks" (the default),
+// "participants" or "view"; View is the client whose view is recorded.
+type Record struct {
+	Recording bool   `json:"recording"`
+	Mode      string `json:"mode,omitempty"`
+	View      int    `json:"view,omitempty"`
+	By        int    `json:"by,omitempty"`
+}
+
+// RoomInfo describes a room in the admin API. Participants is only filled in
+// when a single room is requested.
+type RoomInfo struct {
+	ID           string            `json:"id"`
+	Count        int               `json:"count"`
+	Locked       bool              `json:"locked"`
+	Recording    bool              `json:"recording"`
+	RecordMode   string            `json:"recordMode,omitempty"`
+	Participants []ParticipantInfo `json:"participants,omitempty"`
+}
+
+// ParticipantInfo describes a client in the admin API. Resuming is set while
+// its websocket is gone and its slot is held for a resume; Ingest marks
+// clients that only publish, such as WHIP encoders, and Egress those that
+// only view, such as WHEP players.
+type ParticipantInfo struct {
+	ID         int    `json:"id"`
+	Name       string `json:"name,omitempty"`
+	Role       Role   `json:"role"`
+	Ingest     bool   `json:"ingest,omitempty"`
+	Egress     bool   `json:"egress,omitempty"`
+	Resuming   bool   `json:"resuming"`
+	AudioMuted bool   `json:"audioMuted"`
+	VideoMuted bool   `json:"videoMuted"`
+
+	ICEState       string `json:"iceState"`
+	PeerState      string `json:"peerState"`
+	SignalingState string `json:"signalingState"`
+
+	Stats     ClientStats   `json:"stats"`
+	Published []TrackInfo   `json:"published"`
+	Audio     *SwitcherInfo `json:"audio,omitempty"`
+	Video     *SwitcherInfo `json:"video,omitempty"`
+}
+
+// TrackInfo describes a published track, or one simulcast layer of it.
+type TrackInfo struct {
+	ID          string `json:"id"`
+	Kind        string `json:"kind"`
+	RID         string `json:"rid,omitempty"`
+	Codec       string `json:"codec"`
+	SSRC        uint32 `json:"ssrc"`
+	Bitrate     int    `json:"bitrate"`
+	Subscribers int    `json:"subscribers"`
+}
+
+// SwitcherInfo tells which publisher a client's switched output forwards.
+// Pending is the publisher it is switching to, waiting for a keyframe.
+type SwitcherInfo struct {
+	Source  int  `json:"source"`
+	Pending int  `json:"pending,omitempty"`
+	Pinned  bool `json:"pinned"`
+}
+
+// Quality reports a participant's connection, sent as the "quality" message
+// to it and to everyone else in its room. Level runs from 4, excellent, down
+// to 0, unusable; it is 0 with nothing else set while the participant's
+// media path is down. RTT is in milliseconds.
+type Quality struct {
+	ID    int         `json:"id"`
+	Level int         `json:"level"`
+	RTT   float64     `json:"rtt"`
+	Up    LinkQuality `json:"up"`
+	Down  LinkQuality `json:"down"`
+}
+
+// LinkQuality describes one direction of a connection: Up from the
+// participant to the server, Down back to it. Loss is the fraction of
+// packets lost over the last interval and Jitter is in milliseconds. Bitrate
+// is the measured bitrate upstream and the estimated available bitrate
+// downstream, in bits per second.
+type LinkQuality struct {
+	Loss    float64 `json:"loss"`
+	Jitter  float64 `json:"jitter"`
+	Bitrate int     `json:"bitrate"`
+}
+
+// Incompatible tells a client that a participant's track is not forwarded
+// to it because it cannot receive the track's codec.
+type Incompatible struct {
+	ID    int    `json:"id"`
+	Kind  string `json:"kind"`
+	Codec string `json:"codec"`
+}
+
+// ChatMessage is a chat message relayed over the "chat" data channel,
+// stamped by the server with its sender and the time it arrived in
+// milliseconds since the Unix epoch.
+type ChatMessage struct {
+	From int    `json:"from"`
+	Name string `json:"name,omitempty"`
+	Text string `json:"text"`
+	Time int64  `json:"time"`
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/pion/webrtc/v4"
+)
+
+var errNotModerator = errors.New("only moderators can do that")
+
+// Muted reports whether the client's media of the given kind is muted by a
+// moderator. Muted media is read from the publisher but not forwarded.
+func (c *Client) Muted(kind webrtc.RTPCodecType) bool {
+	if kind == webrtc.RTPCodecTypeAudio {
+		return c.audioMuted.Load()
+	}
+	return c.videoMuted.Load()
+}
+
+// Mute mutes or unmutes a participant's audio, video, or both when kind is
+// empty, and tells everyone in the room.
+func (r *Room) Mute(by *Client, m Mute) error {
+	var kinds []webrtc.RTPCodecType
+	switch m.Kind {
+	case "":
+		kinds = []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo}
+	case "audio":
+		kinds = []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio}
+	case "video":
+		kinds = []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo}
+	default:
+		return fmt.Errorf("unknown kind %q", m.Kind)
+	}
+
+	r.mu.Lock()
+	target, ok := r.clients[m.ID]
+	if !ok {
+		r.mu.Unlock()
+		return fmt.Errorf("client %d is not in the room", m.ID)
+	}
+	for _, kind := range kinds {
+		if kind == webrtc.RTPCodecTypeAudio {
+			target.audioMuted.Store(m.Muted)
+			if m.Muted {
+				r.speakers.Forget(target.ID)
+			}
+			continue
+		}
+
+		target.videoMuted.Store(m.Muted)
+		// Subscribers need a keyframe to pick the video up again.
+		if !m.Muted {
+			for _, t := range r.tracks {
+				if t.Publisher == target && t.Kind() == kind {
+					t.requestKeyframe()
+				}
+			}
+		}
+	}
+	r.mu.Unlock()
+
+	log.Printf("client %d set muted=%t on %q of client %d\n", by.ID, m.Muted, m.Kind, m.ID)
+	m.By = by.ID
+	r.Broadcast("muted", m, 0)
+	return nil
+}
+
+// Lock stops or allows new joins. Clients resuming a session are not
+// affected.
+func (r *Room) Lock(by *Client, locked bool) {
+	r.mu.Lock()
+	r.locked = locked
+	r.mu.Unlock()
+
+	log.Printf("client %d set locked=%t on room %q\n", by.ID, locked, r.ID)
+	r.Broadcast("locked", Lock{Locked: locked, By: by.ID}, 0)
+}
+
+// SetRecording starts or stops recording the room. A recording that is
+// already running is restarted in the requested mode.
+func (r *Room) SetRecording(by *Client, rec Record) error {
+	if r.cfg.Recording.Dir == "" {
+		return errors.New("recording is not configured on this server")
+	}
+	if rec.Mode == "" {
+		rec.Mode = RecordTracks
+	}
+	if !validRecordMode(rec.Mode) {
+		return fmt.Errorf("unknown recording mode %q", rec.Mode)
+	}
+	if rec.Mode != RecordView {
+		rec.View = 0
+	}
+
+	r.recordMu.Lock()
+	defer r.recordMu.Unlock()
+
+	r.mu.Lock()
+	if rec.Recording && rec.Mode == RecordView {
+		if _, ok := r.clients[rec.View]; !ok {
+			r.mu.Unlock()
+			return fmt.Errorf("client %d is not in the room", rec.View)
+		}
+	}
+	var stopped []recorderCloser
+	if r.recording {
+		stopped = r.stopRecordingLocked()
+		r.recording = false
+	}
+	r.mu.Unlock()
+	// The old files are finished before new ones, which may have the same
+	// names, are opened.
+	closeRecorders(stopped)
+
+	r.mu.Lock()
+	r.recording = rec.Recording
+	r.recordMode = rec.Mode
+	r.recordView = rec.View
+	if r.recording {
+		r.startRecordingLocked()
+	}
+	r.mu.Unlock()
+
+	log.Printf("client %d set recording=%t (%s) on room %q\n", by.ID, rec.Recording, rec.Mode, r.ID)
+	rec.By = by.ID
+	r.Broadcast("recording", rec, 0)
+	return nil
+}
+
+// mutedLocked lists the mute state a newly attached client has to be told
+// about.
+func (r *Room) mutedLocked(except int) []Mute {
+	var muted []Mute
+	for _, c := range r.clients {
+		if c.ID == except {
+			continue
+		}
+		audio, video := c.audioMuted.Load(), c.videoMuted.Load()
+		switch {
+		case audio && video:
+			muted = append(muted, Mute{ID: c.ID, Muted: true})
+		case audio:
+			muted = append(muted, Mute{ID: c.ID, Kind: "audio", Muted: true})
+		case video:
+			muted = append(muted, Mute{ID: c.ID, Kind: "video", Muted: true})
+		}
+	}
+	return muted
+}
+
+// kick removes a participant from its room for good: its PeerConnection and
+// websocket are closed and its session cannot be resumed.
+func (s *Server) kick(by *Client, id int) error {
+	if id == by.ID {
+		return errors.New("cannot kick yourself")
+	}
+	target := by.Room.GetClientById(id)
+	if target == nil {
+		return fmt.Errorf("client %d is not in the room", id)
+	}
+
+	log.Printf("client %d kicked client %d from room %q\n", by.ID, id, by.Room.ID)
+	return s.disconnect(target, by.ID)
+}
+
+// disconnect ends the client's session, or its WHIP or WHEP resource, for
+// good and tells its room that it was kicked by the given client, 0 for the
+// server.
+func (s *Server) disconnect(target *Client, by int) error {
+	s.mu.Lock()
+	var sess *session
+	for _, candidate := range s.sessions {
+		if candidate.client == target {
+			sess = candidate
+			break
+		}
+	}
+	s.mu.Unlock()
+	if sess == nil {
+		id := s.resourceID(target)
+		if id == "" {
+			return fmt.Errorf("client %d has no session", target.ID)
+		}
+		target.Room.Broadcast("kicked", Kick{ID: target.ID, By: by}, 0)
+		s.endResource(id)
+		return nil
+	}
+
+	target.Room.Broadcast("kicked", Kick{ID: target.ID, By: by}, 0)
+	s.expire(sess, nil)
+	return nil
+}
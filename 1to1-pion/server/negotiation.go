@@ -0,0 +1,161 @@
+package main
+
+import (
+	"log"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// The server renegotiates whenever subscriptions add or remove transceivers.
+// It follows the perfect negotiation pattern as the impolite peer: a client
+// offer that collides with a pending server offer is ignored, and the client
+// is expected to roll back and answer the server's offer instead.
+
+// negotiate sends a server offer to the client if the connection is stable.
+func (c *Client) negotiate() {
+	c.negMux.Lock()
+	defer c.negMux.Unlock()
+
+	// Until the client's first offer has been answered the browser has not
+	// added its own transceivers yet; pion fires negotiation needed again
+	// once the connection returns to stable.
+	if !c.negotiated || c.PC.SignalingState() != webrtc.SignalingStateStable {
+		return
+	}
+
+	c.sendOfferLocked(nil)
+}
+
+// restartICE sends an offer with fresh ICE credentials so that the media
+// path is re-established over whatever network the client is on now. The
+// transceivers, and with them the forwarding graph, are left untouched. If
+// an offer is already in flight, the restart follows its answer.
+func (c *Client) restartICE() {
+	c.negMux.Lock()
+	defer c.negMux.Unlock()
+
+	if !c.negotiated {
+		return
+	}
+	if c.PC.SignalingState() != webrtc.SignalingStateStable {
+		c.restartPending = true
+		return
+	}
+	c.sendOfferLocked(&webrtc.OfferOptions{ICERestart: true})
+}
+
+// resync catches up with a client that reconnected its websocket. A server
+// offer that may have been lost with the old websocket is sent again, and
+// ICE is restarted if the media path went down in the meantime.
+func (c *Client) resync() {
+	c.negMux.Lock()
+	defer c.negMux.Unlock()
+
+	if !c.negotiated {
+		return
+	}
+	if c.iceDown.Load() {
+		c.restartPending = true
+	}
+
+	if c.PC.SignalingState() == webrtc.SignalingStateHaveLocalOffer {
+		log.Println("resending offer to client", c.ID)
+		if err := c.Send("offer", c.PC.LocalDescription()); err != nil {
+			log.Println("offer write error:", err)
+		}
+		return
+	}
+	if c.restartPending {
+		c.restartPending = false
+		c.sendOfferLocked(&webrtc.OfferOptions{ICERestart: true})
+	}
+}
+
+func (c *Client) sendOfferLocked(options *webrtc.OfferOptions) {
+	offer, err := c.PC.CreateOffer(options)
+	if err != nil {
+		log.Println("create offer error:", err)
+		return
+	}
+	if err := c.PC.SetLocalDescription(offer); err != nil {
+		log.Println("set local offer error:", err)
+		return
+	}
+	c.offerResent = false
+
+	log.Println("sending offer to client", c.ID)
+	if err := c.Send("offer", c.PC.LocalDescription()); err != nil {
+		log.Println("offer write error:", err)
+	}
+}
+
+// handleOffer answers an offer from the client, unless it collides with an
+// offer the server already has in flight. A failure is reported with
+// negotiationError.
+func (c *Client) handleOffer(offer webrtc.SessionDescription) error {
+	c.negMux.Lock()
+	defer c.negMux.Unlock()
+
+	c.ignoreOffer = c.PC.SignalingState() != webrtc.SignalingStateStable
+	if c.ignoreOffer {
+		log.Println("ignoring colliding offer from client", c.ID)
+		return nil
+	}
+
+	// pion would fail to bind the switched outputs and leave the connection
+	// unusable, so an offer that cannot receive them is refused up front.
+	if err := c.checkOutputs(offer.SDP); err != nil {
+		return c.negotiationError(err)
+	}
+	if err := c.PC.SetRemoteDescription(offer); err != nil {
+		return c.negotiationError(err)
+	}
+
+	answer, err := c.PC.CreateAnswer(nil)
+	if err != nil {
+		return c.negotiationError(err)
+	}
+	if err := c.PC.SetLocalDescription(answer); err != nil {
+		return c.negotiationError(err)
+	}
+	c.negotiated = true
+	// Subscriptions added before the client's codecs were known are only
+	// negotiated once this answer is out, so incompatible ones go now.
+	c.Room.dropIncompatible(c)
+
+	log.Println("sending answer to client", c.ID)
+	return c.Send("answer", answer)
+}
+
+// handleAnswer applies the client's answer to a pending server offer. A
+// failure is reported with negotiationError.
+func (c *Client) handleAnswer(answer webrtc.SessionDescription) error {
+	c.negMux.Lock()
+	defer c.negMux.Unlock()
+
+	if c.PC.SignalingState() != webrtc.SignalingStateHaveLocalOffer {
+		log.Println("ignoring unexpected answer from client", c.ID)
+		return nil
+	}
+
+	if err := c.PC.SetRemoteDescription(answer); err != nil {
+		return c.negotiationError(err)
+	}
+	if c.restartPending {
+		c.restartPending = false
+		c.sendOfferLocked(&webrtc.OfferOptions{ICERestart: true})
+	}
+	return nil
+}
+
+// addICECandidate adds a remote candidate. Candidates belonging to an ignored
+// offer are expected to fail and are dropped silently.
+func (c *Client) addICECandidate(candidate webrtc.ICECandidateInit) error {
+	c.negMux.Lock()
+	defer c.negMux.Unlock()
+
+	if err := c.PC.AddICECandidate(candidate); err != nil && !c.ignoreOffer {
+		return err
+	}
+	return nil
+}
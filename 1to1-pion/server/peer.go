@@ -1,23 +1,21 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"log"
 
-	"github.com/gorilla/websocket"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/stats"
+	"github.com/pion/sdp/v3"
 	"github.com/pion/webrtc/v4"
 )
 
+// NewPeer creates the PeerConnection of a client that joined over the
+// websocket. It sends the client the room's switched audio and video, in the
+// preferred codec of each kind, and receives what the client publishes.
 func NewPeer(client *Client, room *Room) (*webrtc.PeerConnection, error) {
-
-	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
-	if err != nil {
-		return nil, err
-	}
-
 	audioTrack, err := webrtc.NewTrackLocalStaticRTP(
-		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus},
+		preferredCodec(room.cfg.Codecs, webrtc.RTPCodecTypeAudio),
 		"audio",
 		"sfu",
 	)
@@ -26,7 +24,7 @@ func NewPeer(client *Client, room *Room) (*webrtc.PeerConnection, error) {
 	}
 
 	videoTrack, err := webrtc.NewTrackLocalStaticRTP(
-		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8},
+		preferredCodec(room.cfg.Codecs, webrtc.RTPCodecTypeVideo),
 		"video",
 		"sfu",
 	)
@@ -34,13 +32,31 @@ func NewPeer(client *Client, room *Room) (*webrtc.PeerConnection, error) {
 		return nil, err
 	}
 
-	if _, err := pc.AddTrack(audioTrack); err != nil {
+	pc, err := newPeerConnection(client, room)
+	if err != nil {
+		return nil, err
+	}
+
+	// Subscribers and egress clients get send-only transceivers, so the
+	// answer to their offer refuses any media they try to send.
+	transceiverInit := webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendrecv}
+	if !client.publishes() {
+		transceiverInit.Direction = webrtc.RTPTransceiverDirectionSendonly
+	}
+
+	audioTransceiver, err := pc.AddTransceiverFromTrack(audioTrack, transceiverInit)
+	if err != nil {
+		pc.Close()
 		return nil, err
 	}
+	audioSender := audioTransceiver.Sender()
 
-	if _, err := pc.AddTrack(videoTrack); err != nil {
+	videoTransceiver, err := pc.AddTransceiverFromTrack(videoTrack, transceiverInit)
+	if err != nil {
+		pc.Close()
 		return nil, err
 	}
+	videoSender := videoTransceiver.Sender()
 
 	client.AudioOut = audioTrack
 	client.VideoOut = videoTrack
@@ -48,23 +64,51 @@ func NewPeer(client *Client, room *Room) (*webrtc.PeerConnection, error) {
 	client.AudioSwitcher = NewMediaSwitcher(audioTrack)
 	client.VideoSwitcher = NewMediaSwitcher(videoTrack)
 
+	go client.AudioSwitcher.readRTCP(audioSender)
+	go client.VideoSwitcher.readRTCP(videoSender)
+
 	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
 		if c == nil {
 			return
 		}
 
 		fmt.Println("sending ice candidate")
-		candidate := c.ToJSON()
-		msg, _ := json.Marshal(MessageOut{
-			Type: "ice",
-			Data: candidate,
-		})
-		client.clientMux.Lock()
-		defer client.clientMux.Unlock()
-		client.Conn.WriteMessage(websocket.TextMessage, msg)
+		if err := client.Send("ice", c.ToJSON()); err != nil {
+			log.Println("ice write error:", err)
+		}
+	})
 
+	pc.OnNegotiationNeeded(func() {
+		go client.negotiate()
 	})
 
+	pc.OnDataChannel(client.acceptChat)
+	return pc, nil
+}
+
+// NewIngestPeer creates the PeerConnection of a client that only publishes,
+// such as a WHIP encoder. Nothing is sent to it, so it has no switchers.
+func NewIngestPeer(client *Client, room *Room) (*webrtc.PeerConnection, error) {
+	return newPeerConnection(client, room)
+}
+
+// newPeerConnection creates a PeerConnection that publishes the client's
+// tracks into the room and tracks its connection state.
+func newPeerConnection(client *Client, room *Room) (*webrtc.PeerConnection, error) {
+	api, err := newAPI(room.cfg, func(bwe cc.BandwidthEstimator) {
+		client.watchBandwidth(bwe, room.cfg.MinVideoBitrate)
+	}, func(getter stats.Getter) {
+		client.stats = getter
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pc, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return nil, err
+	}
+
 	pc.OnSignalingStateChange(func(s webrtc.SignalingState) {
 		fmt.Println("signaling state changed:", s)
 	})
@@ -75,105 +119,54 @@ func NewPeer(client *Client, room *Room) (*webrtc.PeerConnection, error) {
 
 	pc.OnICEConnectionStateChange(func(is webrtc.ICEConnectionState) {
 		log.Println("ICE state:", is.String())
+		iceTransitions.WithLabelValues(is.String()).Inc()
 
-		if is == webrtc.ICEConnectionStateCompleted || is == webrtc.ICEConnectionStateConnected {
+		switch is {
+		case webrtc.ICEConnectionStateCompleted, webrtc.ICEConnectionStateConnected:
 			client.readyOnce.Do(func() {
 				close(client.readyChan)
 				log.Println("client", client.ID, "is READY")
+				room.RequestKeyframes(client.ID)
+				room.Broadcast("ready", Participant{ID: client.ID}, client.ID)
 			})
+			// Frames were lost while the path was down.
+			if client.iceDown.Swap(false) {
+				room.RequestKeyframes(client.ID)
+			}
+
+		case webrtc.ICEConnectionStateDisconnected, webrtc.ICEConnectionStateFailed:
+			client.iceDown.Store(true)
+			go client.restartICE()
 		}
 	})
 
 	pc.OnTrack(func(tr *webrtc.TrackRemote, r *webrtc.RTPReceiver) {
-		log.Printf("Track recieved: kind=%s, codec=%s", tr.Kind(), tr.Codec().MimeType)
-
-		// ---------- Direction B: client1 → client2 ----------
-		if client.ID == 1 {
-			fmt.Println("processing client1")
-			peer := room.GetClientById(2)
-			if peer == nil {
-				return
+		log.Printf("Track recieved: client=%d, kind=%s, codec=%s", client.ID, tr.Kind(), tr.Codec().MimeType)
+
+		// Extra m-lines in a subscriber's offer are not covered by the
+		// send-only transceivers NewPeer adds.
+		if !client.publishes() {
+			log.Printf("Refusing %s track from client %d, which does not publish\n", tr.Kind(), client.ID)
+			if err := r.Stop(); err != nil {
+				log.Println("stop receiver error:", err)
 			}
-
-			<-peer.readyChan
-
-			var out *webrtc.TrackLocalStaticRTP
-			if tr.Kind() == webrtc.RTPCodecTypeVideo {
-				out = peer.VideoOut
-			} else {
-				out = peer.AudioOut
-			}
-
-			go func() {
-				for {
-					pkt, _, err := tr.ReadRTP()
-					if err != nil {
-						return
-					}
-					if err := out.WriteRTP(pkt); err != nil {
-						log.Println("RTP write error:", err)
-						return
-					}
-				}
-			}()
-			return
-		}
-
-		// ---------- Direction A: client2/client3 → client1 ----------
-		if client.ID != 2 && client.ID != 3 {
-			fmt.Println("returning")
-			return
-		}
-
-		fmt.Println("processing client2|3")
-		var peer = room.GetClientById(1)
-
-		if peer == nil {
-			log.Println("no peer to forward to")
 			return
 		}
-		log.Println("fetch other peer-", peer.ID)
-		if peer.PC == nil {
-			fmt.Println("other peer pc nil")
-		}
-		log.Println("waiting for other peer to become ready:", peer.ID)
 
-		<-peer.readyChan
-		fmt.Println(peer.PC.ConnectionState())
-		fmt.Println(peer.PC.ICEConnectionState())
-		log.Println("other peer is ready, start forwarding to:", peer.ID)
-
-		var switcher *MediaSwitcher
+		// Tracks added to subscribers here are negotiated with them on
+		// their next offer/answer exchange.
+		track := NewPublishedTrack(client, tr)
 		if tr.Kind() == webrtc.RTPCodecTypeAudio {
-			switcher = peer.AudioSwitcher
-		} else {
-			switcher = peer.VideoSwitcher
-		}
-		fmt.Println("clientID=", client.ID)
-
-		switcher.SwitchTo(client.ID, peer.PC, tr)
-		fmt.Println("switcher done")
-
-		var lastTS uint32
-
-		for {
-			pkt, _, err := tr.ReadRTP()
-			if err != nil {
-				log.Println("RTP read error:", err)
-				return
-			}
-			oldTS := pkt.Timestamp
-			if lastTS == 0 {
-				pkt.Timestamp = 0
-			} else {
-				pkt.Timestamp = pkt.Timestamp - lastTS
-			}
-			lastTS = oldTS
-
-			if switcher.activeSource == client.ID {
-				switcher.packetChan <- pkt
+			track.audioLevelID = headerExtensionID(r, sdp.AudioLevelURI)
+			track.onAudioLevel = func(level uint8) {
+				room.speakers.Observe(client.ID, level)
 			}
 		}
+		go track.readSenderReports(r)
+		room.Publish(track)
+		defer room.Unpublish(track)
+
+		track.forward()
 	})
 	return pc, nil
 }
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// streamCounters are the cumulative counters of one inbound stream at the
+// previous quality sample.
+type streamCounters struct {
+	received uint64
+	lost     int64
+	bytes    uint64
+}
+
+// qualitySampler turns the cumulative stream statistics of a client's
+// PeerConnection into rates over the last interval. It is only used by its
+// room's reporting goroutine.
+type qualitySampler struct {
+	last    time.Time
+	inbound map[uint32]streamCounters
+}
+
+// reportQuality samples every client's connection on each tick and tells the
+// room about it.
+func (r *Room) reportQuality(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.done:
+			return
+		case now := <-ticker.C:
+			r.mu.Lock()
+			clients := make([]*Client, 0, len(r.clients))
+			for _, c := range r.clients {
+				if c.PC != nil && !c.isLeaving() {
+					clients = append(clients, c)
+				}
+			}
+			r.mu.Unlock()
+
+			for _, c := range clients {
+				q, ok := c.sampleQuality(now)
+				if !ok {
+					continue
+				}
+				r.Broadcast("quality", q, 0)
+			}
+		}
+	}
+}
+
+// sampleQuality measures the client's connection since the previous sample.
+// Upstream loss, jitter and bitrate come from the tracks it publishes;
+// downstream loss, jitter and round-trip time from its receiver reports on
+// the tracks it is sent, and the available bitrate from the bandwidth
+// estimate. It reports false until ICE has connected once, and once the
+// client is leaving.
+func (c *Client) sampleQuality(now time.Time) (Quality, bool) {
+	q := Quality{ID: c.ID}
+	// The PeerConnection is not closed while it is being sampled.
+	c.peerMu.RLock()
+	defer c.peerMu.RUnlock()
+	if c.leaving {
+		return q, false
+	}
+	select {
+	case <-c.readyChan:
+	default:
+		return q, false
+	}
+	if c.iceDown.Load() {
+		// The level of 0 is the news; the counters are stale.
+		return q, true
+	}
+
+	s := &c.quality
+	elapsed := now.Sub(s.last).Seconds()
+	first := s.last.IsZero()
+	s.last = now
+
+	var received, lost int64
+	var bytes uint64
+	inbound := make(map[uint32]streamCounters)
+	for _, receiver := range c.PC.GetReceivers() {
+		for _, track := range receiver.Tracks() {
+			ssrc := uint32(track.SSRC())
+			st := c.stats.Get(ssrc)
+			if st == nil {
+				continue
+			}
+			cur := streamCounters{
+				received: st.InboundRTPStreamStats.PacketsReceived,
+				lost:     st.InboundRTPStreamStats.PacketsLost,
+				bytes:    st.InboundRTPStreamStats.BytesReceived,
+			}
+			inbound[ssrc] = cur
+			q.Up.Jitter = max(q.Up.Jitter, st.InboundRTPStreamStats.Jitter*1000)
+
+			prev, ok := s.inbound[ssrc]
+			if !ok || cur.received < prev.received {
+				continue
+			}
+			received += int64(cur.received - prev.received)
+			lost += max(cur.lost-prev.lost, 0)
+			bytes += cur.bytes - prev.bytes
+		}
+	}
+	s.inbound = inbound
+	if received+lost > 0 {
+		q.Up.Loss = float64(lost) / float64(received+lost)
+	}
+	if !first && elapsed > 0 {
+		q.Up.Bitrate = int(float64(bytes) * 8 / elapsed)
+	}
+
+	var reportRTT time.Duration
+	for _, sender := range c.PC.GetSenders() {
+		for _, encoding := range sender.GetParameters().Encodings {
+			st := c.stats.Get(uint32(encoding.SSRC))
+			if st == nil || st.RemoteInboundRTPStreamStats.PacketsReceived == 0 {
+				continue
+			}
+			remote := st.RemoteInboundRTPStreamStats
+			q.Down.Loss = max(q.Down.Loss, remote.FractionLost)
+			q.Down.Jitter = max(q.Down.Jitter, remote.Jitter*1000)
+			reportRTT = max(reportRTT, remote.RoundTripTime)
+		}
+	}
+	q.Down.Bitrate = c.BandwidthEstimate()
+
+	// The nominated candidate pair's STUN round trips measure the path
+	// itself; receiver reports are the fallback.
+	rtt := reportRTT
+	for _, st := range c.PC.GetStats() {
+		if pair, ok := st.(webrtc.ICECandidatePairStats); ok && pair.Nominated && pair.CurrentRoundTripTime > 0 {
+			rtt = time.Duration(pair.CurrentRoundTripTime * float64(time.Second))
+			break
+		}
+	}
+	q.RTT = float64(rtt) / float64(time.Millisecond)
+	q.Level = qualityLevel(max(q.Up.Loss, q.Down.Loss), rtt)
+	return q, true
+}
+
+// qualityLevel grades a connection from 4, excellent, down to 0, unusable.
+func qualityLevel(loss float64, rtt time.Duration) int {
+	switch {
+	case loss < 0.02 && rtt < 150*time.Millisecond:
+		return 4
+	case loss < 0.05 && rtt < 300*time.Millisecond:
+		return 3
+	case loss < 0.10 && rtt < 500*time.Millisecond:
+		return 2
+	case loss < 0.20 && rtt < time.Second:
+		return 1
+	}
+	return 0
+}
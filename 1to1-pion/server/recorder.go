@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+	"github.com/pion/webrtc/v4/pkg/media/ivfwriter"
+	"github.com/pion/webrtc/v4/pkg/media/oggwriter"
+	"github.com/pion/webrtc/v4/pkg/media/samplebuilder"
+)
+
+// recordMaxLate is how many packets a recorder holds back to put reordered
+// packets in place before it gives up on a missing one.
+const recordMaxLate = 128
+
+// mediaWriter is implemented by pion's IVF and Ogg writers.
+type mediaWriter interface {
+	WriteRTP(pkt *rtp.Packet) error
+	Close() error
+}
+
+// TrackRecorder writes a published track to disk: VP8 to IVF and Opus to
+// Ogg. Packets go through a sample builder first, so the file gets whole
+// frames in order; video that lost a frame resumes on the next keyframe.
+type TrackRecorder struct {
+	track  *PublishedTrack
+	path   string
+	writer mediaWriter
+
+	builder      *samplebuilder.SampleBuilder
+	video        bool
+	needKeyframe bool
+
+	packetChan chan *rtp.Packet
+	closeOnce  sync.Once
+	done       chan struct{}
+	stopped    chan struct{}
+}
+
+// NewTrackRecorder starts recording t to a new file in dir.
+func NewTrackRecorder(t *PublishedTrack, dir string) (*TrackRecorder, error) {
+	codec := t.Remote.Codec()
+	name := fmt.Sprintf("%s-%d-%s", t.Kind(), t.Remote.SSRC(), time.Now().Format("20060102-150405"))
+	if t.RID != "" {
+		name += "-" + t.RID
+	}
+
+	rec := &TrackRecorder{
+		track:        t,
+		video:        t.Kind() == webrtc.RTPCodecTypeVideo,
+		needKeyframe: true,
+		packetChan:   make(chan *rtp.Packet, 100),
+		done:         make(chan struct{}),
+		stopped:      make(chan struct{}),
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	var depacketizer rtp.Depacketizer
+	switch {
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeVP8):
+		rec.path = filepath.Join(dir, name+".ivf")
+		w, err := ivfwriter.New(rec.path, ivfwriter.WithCodec(webrtc.MimeTypeVP8))
+		if err != nil {
+			return nil, err
+		}
+		rec.writer = w
+		depacketizer = &codecs.VP8Packet{}
+
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeOpus):
+		rec.path = filepath.Join(dir, name+".ogg")
+		w, err := oggwriter.New(rec.path, codec.ClockRate, codec.Channels)
+		if err != nil {
+			return nil, err
+		}
+		rec.writer = w
+		depacketizer = &codecs.OpusPacket{}
+
+	default:
+		return nil, fmt.Errorf("recording %s is not supported", codec.MimeType)
+	}
+	rec.builder = samplebuilder.New(recordMaxLate, depacketizer, codec.ClockRate)
+
+	log.Printf("recording client %d %s to %s\n", t.Publisher.ID, t.Kind(), rec.path)
+	go rec.run()
+	return rec, nil
+}
+
+// Push queues a packet read from the track. Packets that find the queue full
+// are dropped: a slow disk must not hold up the publisher's subscribers.
+func (rec *TrackRecorder) Push(pkt *rtp.Packet) {
+	select {
+	case rec.packetChan <- pkt.Clone():
+	case <-rec.done:
+	default:
+		recorderDrops.WithLabelValues(rec.track.Kind().String()).Inc()
+	}
+}
+
+// Close writes out what is still buffered and closes the file.
+func (rec *TrackRecorder) Close() {
+	rec.closeOnce.Do(func() {
+		close(rec.done)
+	})
+	<-rec.stopped
+}
+
+func (rec *TrackRecorder) run() {
+	defer close(rec.stopped)
+
+	for {
+		select {
+		case <-rec.done:
+			rec.builder.Flush()
+			rec.popSamples()
+			if err := rec.writer.Close(); err != nil {
+				log.Println("recording close error:", err)
+			}
+			log.Println("recording finished:", rec.path)
+			return
+
+		case pkt := <-rec.packetChan:
+			rec.builder.Push(pkt)
+			rec.popSamples()
+		}
+	}
+}
+
+func (rec *TrackRecorder) popSamples() {
+	for sample := rec.builder.Pop(); sample != nil; sample = rec.builder.Pop() {
+		if err := rec.writeSample(sample); err != nil {
+			log.Println("recording write error:", err)
+		}
+	}
+}
+
+// writeSample hands a complete frame to the writer as a single packet; the
+// writers depacketize what they are given.
+func (rec *TrackRecorder) writeSample(sample *media.Sample) error {
+	payload := sample.Data
+	if rec.video {
+		if sample.PrevDroppedPackets > 0 {
+			rec.needKeyframe = true
+		}
+		if rec.needKeyframe {
+			// The VP8 frame tag's P bit is clear on keyframes.
+			if len(payload) == 0 || payload[0]&0x01 != 0 {
+				rec.track.requestKeyframe()
+				return nil
+			}
+			rec.needKeyframe = false
+		}
+		// A VP8 payload descriptor with only the start-of-partition bit.
+		payload = append([]byte{0x10}, payload...)
+	}
+
+	return rec.writer.WriteRTP(&rtp.Packet{
+		Header: rtp.Header{
+			Version:   2,
+			Marker:    true,
+			Timestamp: sample.PacketTimestamp,
+		},
+		Payload: payload,
+	})
+}
+
+// startRecording starts recording the track into dir unless it is already
+// being recorded.
+func (t *PublishedTrack) startRecording(dir string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.recorder != nil {
+		return nil
+	}
+
+	rec, err := NewTrackRecorder(t, dir)
+	if err != nil {
+		return err
+	}
+	t.recorder = rec
+	return nil
+}
+
+// detachRecorder stops feeding the track's recorder and returns it, or nil.
+// The caller closes it once the room's lock is released.
+func (t *PublishedTrack) detachRecorder() *TrackRecorder {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	rec := t.recorder
+	t.recorder = nil
+	return rec
+}
+
+// recorderCloser is a recording detached under the room's lock. Closing it
+// waits until its file is written out, so that is left until the lock is
+// released.
+type recorderCloser interface {
+	Close()
+}
+
+func closeRecorders(recs []recorderCloser) {
+	for _, rec := range recs {
+		rec.Close()
+	}
+}
+
+// recordDir is the directory recordings of the given client are written to.
+func (r *Room) recordDir(id int) string {
+	return filepath.Join(r.cfg.Recording.Dir, safePathElement(r.ID), fmt.Sprintf("client-%d", id))
+}
+
+// safePathElement turns a room ID, which comes from the client, into a single
+// harmless path element.
+func safePathElement(s string) string {
+	safe := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, s)
+	if safe == "" {
+		return "_"
+	}
+	return safe
+}
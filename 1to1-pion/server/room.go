@@ -1,26 +1,86 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"log"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v4"
 )
 
 type Room struct {
+	ID string
+
+	cfg      Config
+	speakers *ActiveSpeakerDetector
+
 	mu      sync.Mutex
 	clients map[int]*Client
+	tracks  []*PublishedTrack
+	counter int32
+	locked  bool
+	// chat holds the most recent chat messages for clients that join later.
+	chat []ChatMessage
+
+	// recording is set while the room is recorded in recordMode. mixers
+	// holds the mixed recordings by participant, or by the viewing client
+	// in view mode.
+	recording  bool
+	recordMode string
+	recordView int
+	mixers     map[int]*MixedRecorder
+	// recordMu serializes SetRecording, which closes the previous
+	// recording between two sections under mu.
+	recordMu sync.Mutex
+
+	closeOnce sync.Once
+	done      chan struct{}
 }
 
-func NewRoom() *Room {
-	return &Room{
-		clients: make(map[int]*Client),
+func NewRoom(id string, cfg Config) *Room {
+	r := &Room{
+		ID:         id,
+		cfg:        cfg,
+		speakers:   NewActiveSpeakerDetector(cfg.Speaker),
+		clients:    make(map[int]*Client),
+		recording:  cfg.Recording.records(id),
+		recordMode: cfg.Recording.Mode,
+		recordView: cfg.Recording.View,
+		mixers:     make(map[int]*MixedRecorder),
+		done:       make(chan struct{}),
+	}
+	if cfg.Speaker.Interval > 0 {
+		go r.detectSpeakers(cfg.Speaker.Interval)
 	}
+	if cfg.QualityInterval > 0 {
+		go r.reportQuality(cfg.QualityInterval)
+	}
+	return r
+}
+
+// Close stops the room's background work.
+func (r *Room) Close() {
+	r.closeOnce.Do(func() {
+		close(r.done)
+	})
+}
+
+func (r *Room) nextID() int {
+	return int(atomic.AddInt32(&r.counter, 1))
 }
 
 func (r *Room) Add(c *Client) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	if len(r.clients) >= 3 {
+	if r.locked {
+		return fmt.Errorf("room locked")
+	}
+	if r.cfg.MaxClients > 0 && len(r.clients) >= r.cfg.MaxClients {
 		return fmt.Errorf("room full")
 	}
 
@@ -28,10 +88,423 @@ func (r *Room) Add(c *Client) error {
 	return nil
 }
 
-func (r *Room) Remove(id int) {
+// Attach sets the client's PeerConnection and subscribes it to every track
+// already published in the room.
+func (r *Room) Attach(c *Client, pc *webrtc.PeerConnection) {
+	r.mu.Lock()
+	c.PC = pc
+	var groups []*simulcastGroup
+	var layers []LayersInfo
+	for _, t := range r.tracks {
+		if t.Publisher.ID == c.ID || c.Ingest {
+			continue
+		}
+		if err := t.subscribe(c); err != nil {
+			log.Printf("subscribe client %d to client %d failed: %v\n", c.ID, t.Publisher.ID, err)
+		}
+		if t.group != nil && !slices.Contains(groups, t.group) {
+			groups = append(groups, t.group)
+			layers = append(layers, layersInfo(t))
+		}
+	}
+	muted := r.mutedLocked(c.ID)
+	locked := r.locked
+	recording := Record{Recording: r.recording, Mode: r.recordMode, View: r.recordView}
+	if r.recording {
+		r.recordClientLocked(c)
+	}
+	r.mu.Unlock()
+
+	for _, info := range layers {
+		if err := c.Send("layers", info); err != nil {
+			log.Println("layers write error:", err)
+		}
+	}
+	for _, m := range muted {
+		if err := c.Send("muted", m); err != nil {
+			log.Println("muted write error:", err)
+		}
+	}
+	if locked {
+		if err := c.Send("locked", Lock{Locked: true}); err != nil {
+			log.Println("locked write error:", err)
+		}
+	}
+	if recording.Recording {
+		if err := c.Send("recording", recording); err != nil {
+			log.Println("recording write error:", err)
+		}
+	}
+	r.Broadcast("joined", Participant{ID: c.ID, Name: c.Name}, c.ID)
+}
+
+// Publish adds a track to the room and subscribes every other attached client
+// to it. Simulcast layers are grouped with the other layers of their track.
+func (r *Room) Publish(t *PublishedTrack) {
+	r.mu.Lock()
+	if t.RID != "" {
+		group := newSimulcastGroup()
+		for _, other := range r.tracks {
+			if other.group != nil && other.Publisher == t.Publisher && other.Remote.ID() == t.Remote.ID() {
+				group = other.group
+				break
+			}
+		}
+		group.addLayer(t)
+	}
+
+	r.tracks = append(r.tracks, t)
+	if r.recording {
+		r.recordTrackLocked(t)
+	}
+	var incompatible []*Client
+	for _, c := range r.clients {
+		if c.ID == t.Publisher.ID || !c.subscribes() {
+			continue
+		}
+		if err := t.subscribe(c); err != nil {
+			log.Printf("subscribe client %d to client %d failed: %v\n", c.ID, t.Publisher.ID, err)
+			if errors.Is(err, errIncompatibleCodec) {
+				incompatible = append(incompatible, c)
+			}
+		}
+	}
+	r.mu.Unlock()
+
+	for _, c := range incompatible {
+		c.reportIncompatible(t)
+	}
+
+	if t.group != nil {
+		r.Broadcast("layers", layersInfo(t), t.Publisher.ID)
+	}
+}
+
+func layersInfo(t *PublishedTrack) LayersInfo {
+	return LayersInfo{
+		ID:      t.Publisher.ID,
+		TrackID: t.Remote.ID(),
+		RIDs:    t.group.RIDs(),
+	}
+}
+
+// Unpublish removes a track from the room and from every subscriber.
+func (r *Room) Unpublish(t *PublishedTrack) {
+	r.mu.Lock()
+	rec := r.unpublishLocked(t)
+	r.mu.Unlock()
+
+	if rec != nil {
+		rec.Close()
+	}
+}
+
+// unpublishLocked removes the track and returns its recorder, if it had one,
+// for the caller to close.
+func (r *Room) unpublishLocked(t *PublishedTrack) *TrackRecorder {
+	i := slices.Index(r.tracks, t)
+	if i < 0 {
+		return nil
+	}
+	r.tracks = slices.Delete(r.tracks, i, i+1)
+	if t.group != nil {
+		t.group.removeLayer(t)
+	}
+	rec := t.detachRecorder()
+	t.setMixer(nil)
+
+	t.mu.RLock()
+	ids := make([]int, 0, len(t.subs))
+	for id := range t.subs {
+		ids = append(ids, id)
+	}
+	t.mu.RUnlock()
+	for _, id := range ids {
+		t.unsubscribe(id, true)
+	}
+	return rec
+}
+
+// RequestKeyframes asks every publisher other than the given client for a
+// keyframe, so that a newly connected subscriber can start decoding.
+func (r *Room) RequestKeyframes(subID int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, t := range r.tracks {
+		if t.Publisher.ID != subID {
+			t.requestKeyframe()
+		}
+	}
+}
+
+// Broadcast sends a signaling message to every client in the room except the
+// one with the given ID.
+func (r *Room) Broadcast(msgType string, data any, exceptID int) {
+	r.mu.Lock()
+	clients := make([]*Client, 0, len(r.clients))
+	for _, c := range r.clients {
+		if c.ID != exceptID && !c.isLeaving() {
+			clients = append(clients, c)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, c := range clients {
+		if err := c.Send(msgType, data); err != nil {
+			log.Printf("%s write error to client %d: %v\n", msgType, c.ID, err)
+		}
+	}
+}
+
+func (r *Room) detectSpeakers(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.done:
+			return
+		case now := <-ticker.C:
+			if speaker, changed := r.speakers.Evaluate(now); changed {
+				r.switchToSpeaker(speaker)
+			}
+		}
+	}
+}
+
+// switchToSpeaker points every other client's switchers at the speaker's
+// tracks and tells all clients who is speaking.
+func (r *Room) switchToSpeaker(speaker int) {
+	log.Printf("Room %q active speaker: client %d\n", r.ID, speaker)
+
+	r.mu.Lock()
+	audio := r.trackLocked(speaker, webrtc.RTPCodecTypeAudio)
+	video := r.trackLocked(speaker, webrtc.RTPCodecTypeVideo)
+	for _, c := range r.clients {
+		if c.ID == speaker || !c.subscribes() {
+			continue
+		}
+		if audio != nil {
+			c.AudioSwitcher.Follow(audio)
+		}
+		if video != nil {
+			c.VideoSwitcher.Follow(layerFor(c, video))
+		}
+	}
+	r.mu.Unlock()
+
+	r.Broadcast("active-speaker", Participant{ID: speaker}, 0)
+}
+
+// SelectSource pins the client's switchers of the given kind, or of both
+// kinds when kind is empty, to another participant. A sourceID of 0 unpins
+// them and returns them to the active speaker.
+func (r *Room) SelectSource(c *Client, sourceID int, kind string) error {
+	var kinds []webrtc.RTPCodecType
+	switch kind {
+	case "":
+		kinds = []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo}
+	case "audio", "video":
+		kinds = []webrtc.RTPCodecType{webrtc.NewRTPCodecType(kind)}
+	default:
+		return fmt.Errorf("unknown kind %q", kind)
+	}
+
+	if sourceID == c.ID {
+		return fmt.Errorf("cannot select own source")
+	}
+
+	follow := sourceID
+	if sourceID == 0 {
+		follow = r.speakers.Current()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	found := false
+	for _, k := range kinds {
+		switcher := c.VideoSwitcher
+		if k == webrtc.RTPCodecTypeAudio {
+			switcher = c.AudioSwitcher
+		}
+
+		t := r.trackLocked(follow, k)
+		if t != nil {
+			t = layerFor(c, t)
+		}
+		if sourceID == 0 {
+			switcher.Unpin()
+			if t != nil && follow != c.ID {
+				switcher.Follow(t)
+			}
+			continue
+		}
+		if t != nil {
+			if err := checkCodec(t, switcher.outTrack.Codec()); err != nil {
+				return err
+			}
+			switcher.Pin(t)
+			found = true
+		}
+	}
+
+	if sourceID != 0 && !found {
+		return fmt.Errorf("client %d has no matching track", sourceID)
+	}
+	return nil
+}
+
+// trackLocked returns the track of the given kind published by a client.
+func (r *Room) trackLocked(publisherID int, kind webrtc.RTPCodecType) *PublishedTrack {
+	for _, t := range r.tracks {
+		if t.Publisher.ID == publisherID && t.Kind() == kind {
+			return t
+		}
+	}
+	return nil
+}
+
+// layerFor returns the simulcast layer of t that is forwarded to c, or t
+// itself when it is not simulcast.
+func layerFor(c *Client, t *PublishedTrack) *PublishedTrack {
+	if t.group == nil {
+		return t
+	}
+	if s := t.group.sub(c.ID); s != nil {
+		if layer := s.layers.Target(); layer != nil {
+			return layer
+		}
+	}
+	return t
+}
+
+// SelectLayers re-evaluates which simulcast layer of every other publisher is
+// forwarded to c. The client's bandwidth estimate is split evenly across its
+// video outputs, including the main switched view.
+func (r *Room) SelectLayers(c *Client) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+
+	outputs := 1
+	var groups []*simulcastGroup
+	for _, t := range r.tracks {
+		if t.Publisher.ID == c.ID || t.Kind() != webrtc.RTPCodecTypeVideo {
+			continue
+		}
+		if t.group == nil {
+			outputs++
+		} else if !slices.Contains(groups, t.group) {
+			groups = append(groups, t.group)
+			outputs++
+		}
+	}
+
+	budget := c.BandwidthEstimate() / outputs
+	for _, g := range groups {
+		g.applyLayer(c, budget)
+	}
+}
+
+// SetLayerPreference pins the simulcast layer c receives from a publisher. An
+// empty rid returns to bandwidth-based selection.
+func (r *Room) SetLayerPreference(c *Client, publisherID int, rid string) error {
+	r.mu.Lock()
+	var groups []*simulcastGroup
+	for _, t := range r.tracks {
+		if t.Publisher.ID == publisherID && t.group != nil && !slices.Contains(groups, t.group) {
+			groups = append(groups, t.group)
+		}
+	}
+	r.mu.Unlock()
+
+	if len(groups) == 0 {
+		return fmt.Errorf("client %d does not publish simulcast", publisherID)
+	}
+
+	found := rid == ""
+	for _, g := range groups {
+		if rid == "" || g.hasLayer(rid) {
+			g.setPreference(c.ID, rid)
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("client %d has no layer %q", publisherID, rid)
+	}
+
+	r.SelectLayers(c)
+	return nil
+}
+
+// Remove drops the client together with the tracks it published and its
+// subscriptions, moves everyone who was watching it to another source, tells
+// the others it left, and reports whether the room is now empty.
+func (r *Room) Remove(id int) bool {
+	r.speakers.Forget(id)
+
+	r.mu.Lock()
+	_, ok := r.clients[id]
 	delete(r.clients, id)
+	var recs []recorderCloser
+	if m := r.detachMixerLocked(id); m != nil {
+		recs = append(recs, m)
+	}
+	for _, t := range slices.Clone(r.tracks) {
+		if t.Publisher.ID == id {
+			if rec := r.unpublishLocked(t); rec != nil {
+				recs = append(recs, rec)
+			}
+		} else {
+			t.unsubscribe(id, false)
+		}
+	}
+	for _, c := range r.clients {
+		if !c.subscribes() {
+			continue
+		}
+		if c.AudioSwitcher.Drop(id) {
+			r.replaceSourceLocked(c, c.AudioSwitcher, webrtc.RTPCodecTypeAudio)
+		}
+		if c.VideoSwitcher.Drop(id) {
+			r.replaceSourceLocked(c, c.VideoSwitcher, webrtc.RTPCodecTypeVideo)
+		}
+	}
+	empty := len(r.clients) == 0
+	r.mu.Unlock()
+	closeRecorders(recs)
+
+	if ok {
+		r.Broadcast("left", Participant{ID: id}, id)
+	}
+	return empty
+}
+
+// replaceSourceLocked points a switcher that lost its source at the active
+// speaker, or at any other publisher when the speaker is unknown.
+func (r *Room) replaceSourceLocked(c *Client, switcher *MediaSwitcher, kind webrtc.RTPCodecType) {
+	var t *PublishedTrack
+	if speaker := r.speakers.Current(); speaker != 0 && speaker != c.ID {
+		t = r.trackLocked(speaker, kind)
+	}
+	if t == nil {
+		for _, other := range r.tracks {
+			if other.Publisher.ID != c.ID && other.Kind() == kind {
+				t = other
+				break
+			}
+		}
+	}
+	if t != nil {
+		switcher.Follow(layerFor(c, t))
+	}
+}
+
+func (r *Room) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.clients)
 }
 
 func (r *Room) Other(id int) *Client {
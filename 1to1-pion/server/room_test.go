@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// testPeer is an in-process stand-in for a browser: it joins over the
+// websocket, publishes audio and video, simulcast when asked, and counts
+// the tracks it receives packets on.
+type testPeer struct {
+	ws  *websocket.Conn
+	wmu sync.Mutex
+	pc  *webrtc.PeerConnection
+
+	// Simulcast layers are tagged with their MID and RID once the
+	// header extensions are negotiated.
+	mu           sync.Mutex
+	sender       *webrtc.RTPSender
+	mid          string
+	midID, ridID uint8
+
+	done     chan struct{}
+	stopped  sync.WaitGroup
+	receives atomic.Int32
+}
+
+func newTestPeer(t *testing.T, url string, simulcast bool) *testPeer {
+	t.Helper()
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testPeer{ws: ws, pc: pc, done: make(chan struct{})}
+
+	audio, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "peer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pc.AddTrack(audio); err != nil {
+		t.Fatal(err)
+	}
+	var videos []*webrtc.TrackLocalStaticRTP
+	var rids []string
+	if simulcast {
+		rids = []string{"q", "h", "f"}
+	} else {
+		rids = []string{""}
+	}
+	for _, rid := range rids {
+		var opts []func(*webrtc.TrackLocalStaticRTP)
+		if rid != "" {
+			opts = append(opts, webrtc.WithRTPStreamID(rid))
+		}
+		v, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "video", "peer", opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		videos = append(videos, v)
+	}
+	sender, err := pc.AddTrack(videos[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range videos[1:] {
+		if err := sender.AddEncoding(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c != nil {
+			p.send("ice", c.ToJSON())
+		}
+	})
+	pc.OnTrack(func(tr *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		if _, _, err := tr.ReadRTP(); err != nil {
+			return
+		}
+		p.receives.Add(1)
+		for {
+			if _, _, err := tr.ReadRTP(); err != nil {
+				return
+			}
+		}
+	})
+
+	p.sender = sender
+	p.stopped.Add(2)
+	go p.read()
+	go p.publish(audio, videos)
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	p.send("offer", offer)
+	return p
+}
+
+func (p *testPeer) send(msgType string, data any) {
+	b, _ := json.Marshal(data)
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+	p.ws.WriteJSON(Message{Type: msgType, Data: b})
+}
+
+func (p *testPeer) read() {
+	defer p.stopped.Done()
+	for {
+		var msg Message
+		if err := p.ws.ReadJSON(&msg); err != nil {
+			return
+		}
+		switch msg.Type {
+		case "offer", "answer":
+			var desc webrtc.SessionDescription
+			json.Unmarshal(msg.Data, &desc)
+			if err := p.pc.SetRemoteDescription(desc); err != nil {
+				continue
+			}
+			if msg.Type == "answer" {
+				p.tagLayers()
+				continue
+			}
+			answer, err := p.pc.CreateAnswer(nil)
+			if err != nil {
+				continue
+			}
+			p.pc.SetLocalDescription(answer)
+			p.send("answer", answer)
+		case "ice":
+			var candidate webrtc.ICECandidateInit
+			json.Unmarshal(msg.Data, &candidate)
+			p.pc.AddICECandidate(candidate)
+		}
+	}
+}
+
+// tagLayers records the MID and RID extension IDs negotiated for the video
+// sender. It runs on the read goroutine, between negotiations.
+func (p *testPeer) tagLayers() {
+	var midID, ridID uint8
+	for _, ext := range p.sender.GetParameters().HeaderExtensions {
+		switch ext.URI {
+		case "urn:ietf:params:rtp-hdrext:sdes:mid":
+			midID = uint8(ext.ID)
+		case "urn:ietf:params:rtp-hdrext:sdes:rtp-stream-id":
+			ridID = uint8(ext.ID)
+		}
+	}
+	var mid string
+	for _, tr := range p.pc.GetTransceivers() {
+		if tr.Sender() == p.sender {
+			mid = tr.Mid()
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.mid, p.midID, p.ridID = mid, midID, ridID
+}
+
+// publish sends a VP8 keyframe every 30 frames and a constant Opus frame
+// until the peer is closed. Simulcast layers carry their MID and RID.
+func (p *testPeer) publish(audio *webrtc.TrackLocalStaticRTP, videos []*webrtc.TrackLocalStaticRTP) {
+	defer p.stopped.Done()
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+
+	for i := 0; ; i++ {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+
+		p.mu.Lock()
+		mid, midID, ridID := p.mid, p.midID, p.ridID
+		p.mu.Unlock()
+
+		tag := byte(0x01)
+		if i%30 == 0 {
+			tag = 0x00
+		}
+		for j, v := range videos {
+			pkt := &rtp.Packet{
+				Header:  rtp.Header{Version: 2, Marker: true, SequenceNumber: uint16(i), Timestamp: uint32(i) * 1800},
+				Payload: append([]byte{0x10, tag}, make([]byte, 100*(j+1))...),
+			}
+			if v.RID() != "" && midID != 0 && ridID != 0 {
+				pkt.Header.SetExtension(midID, []byte(mid))
+				pkt.Header.SetExtension(ridID, []byte(v.RID()))
+			}
+			v.WriteRTP(pkt)
+		}
+		audio.WriteRTP(&rtp.Packet{
+			Header:  rtp.Header{Version: 2, SequenceNumber: uint16(i), Timestamp: uint32(i) * 960},
+			Payload: []byte{0xfc, 1, 2, 3},
+		})
+	}
+}
+
+// leave closes the peer the way a browser tab going away does.
+func (p *testPeer) leave() {
+	close(p.done)
+	p.pc.Close()
+	p.ws.Close()
+	p.stopped.Wait()
+}
+
+// waitFor polls cond until it holds or the timeout passes.
+func waitFor(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return true
+}
+
+func goroutineDump() string {
+	var buf bytes.Buffer
+	pprof.Lookup("goroutine").WriteTo(&buf, 1)
+	return buf.String()
+}
+
+// TestRoomRemoveLeaksNoGoroutines fills a room with publishers, one of them
+// simulcast, lets media flow through every switcher and subscription, and
+// checks that all goroutines are gone once everyone has left and the room
+// is closed.
+func TestRoomRemoveLeaksNoGoroutines(t *testing.T) {
+	const peers = 3
+
+	s := NewServer(Config{
+		Codecs:          []string{"opus", "vp8"},
+		QualityInterval: 100 * time.Millisecond,
+		Speaker: SpeakerConfig{
+			Interval: 50 * time.Millisecond,
+			MinHold:  100 * time.Millisecond,
+		},
+	})
+	ts := httptest.NewServer(http.HandlerFunc(s.HandleWS))
+	defer ts.Close()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws?room=leak"
+
+	before := runtime.NumGoroutine()
+
+	var ps []*testPeer
+	for i := 0; i < peers; i++ {
+		ps = append(ps, newTestPeer(t, url, i == 0))
+	}
+	// Each peer receives the switched audio and a track per kind from
+	// every other peer. The switched video of the active speaker has no one
+	// to follow, so it is not counted.
+	want := int32(1 + 2*(peers-1))
+	if !waitFor(15*time.Second, func() bool {
+		for _, p := range ps {
+			if p.receives.Load() < want {
+				return false
+			}
+		}
+		return true
+	}) {
+		for i, p := range ps {
+			t.Logf("peer %d receives %d tracks", i, p.receives.Load())
+		}
+		t.Fatalf("media did not reach every peer on %d tracks", want)
+	}
+
+	s.mu.Lock()
+	room := s.rooms["leak"]
+	s.mu.Unlock()
+	room.mu.Lock()
+	layered := 0
+	for _, tr := range room.tracks {
+		if tr.group != nil {
+			for _, sub := range tr.group.subs {
+				if sub.layers != nil {
+					layered++
+				}
+			}
+			break
+		}
+	}
+	room.mu.Unlock()
+	if layered != peers-1 {
+		t.Fatalf("%d subscribers have a layer switcher, want %d", layered, peers-1)
+	}
+
+	for _, p := range ps {
+		p.leave()
+	}
+	if !waitFor(10*time.Second, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.rooms) == 0
+	}) {
+		t.Fatal("room was not closed after everyone left")
+	}
+
+	if !waitFor(10*time.Second, func() bool {
+		return runtime.NumGoroutine() <= before
+	}) {
+		t.Fatalf("%d goroutines before, %d after everyone left:\n%s",
+			before, runtime.NumGoroutine(), goroutineDump())
+	}
+}
+
+// TestGetStatsReportsInbound checks that the stats interceptor quality
+// sampling adds does not take inbound-rtp stats away from GetStats.
+func TestGetStatsReportsInbound(t *testing.T) {
+	s := NewServer(Config{Codecs: []string{"opus", "vp8"}})
+	ts := httptest.NewServer(http.HandlerFunc(s.HandleWS))
+	defer ts.Close()
+	p := newTestPeer(t, "ws"+strings.TrimPrefix(ts.URL, "http")+"/ws?room=stats", false)
+	defer p.leave()
+
+	inbound := func() map[string]uint32 {
+		s.mu.Lock()
+		room := s.rooms["stats"]
+		s.mu.Unlock()
+		if room == nil {
+			return nil
+		}
+		room.mu.Lock()
+		var pc *webrtc.PeerConnection
+		for _, c := range room.clients {
+			pc = c.PC
+		}
+		room.mu.Unlock()
+		if pc == nil {
+			return nil
+		}
+		packets := make(map[string]uint32)
+		for _, st := range pc.GetStats() {
+			if in, ok := st.(webrtc.InboundRTPStreamStats); ok {
+				packets[in.Kind] = in.PacketsReceived
+			}
+		}
+		return packets
+	}
+	if !waitFor(10*time.Second, func() bool {
+		packets := inbound()
+		return packets["audio"] > 0 && packets["video"] > 0
+	}) {
+		t.Fatalf("GetStats inbound packets by kind: %v", inbound())
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// rewriteWindow is how many sequence numbers behind the newest packet a late
+// packet is still forwarded, and a NACK still mapped back to its source.
+const rewriteWindow = 1 << 14
+
+// RTPRewriter maps packets from a changing source onto a single outbound
+// stream with one SSRC and continuous sequence number and timestamp spaces.
+//
+// Within a source, sequence numbers and timestamps keep their original
+// spacing, so loss gaps are preserved and reordered packets keep their
+// place. On a switch, the new source is spliced on right after the last
+// packet written, with the timestamp advanced by the wall-clock time that
+// passed since then.
+type RTPRewriter struct {
+	ssrc uint32
+
+	mu sync.Mutex
+
+	started bool
+	source  *PublishedTrack
+
+	// seqOffset and tsOffset are added to the current source's numbering.
+	seqOffset uint16
+	tsOffset  uint32
+
+	// baseSeq is the oldest sequence number of the current source still
+	// accepted: the first one seen after the switch, then rewriteWindow
+	// behind highSeq. Anything older is dropped.
+	baseSeq uint16
+	highSeq uint16
+
+	// lastSeq and lastTS describe the newest packet written, lastArrival is
+	// when it was received.
+	lastSeq     uint16
+	lastTS      uint32
+	lastArrival time.Time
+}
+
+func NewRTPRewriter() *RTPRewriter {
+	return &RTPRewriter{
+		ssrc: rand.Uint32(),
+	}
+}
+
+// Rewrite rewrites pkt in place. clockRate is the source's RTP clock rate and
+// arrival is when the packet was received. It reports false when the packet
+// must be dropped.
+func (rw *RTPRewriter) Rewrite(source *PublishedTrack, clockRate uint32, pkt *rtp.Packet, arrival time.Time) bool {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	if !rw.started || source != rw.source {
+		rw.switchTo(source, clockRate, pkt, arrival)
+	}
+
+	if int16(pkt.SequenceNumber-rw.baseSeq) < 0 {
+		return false
+	}
+
+	newest := int16(pkt.SequenceNumber-rw.highSeq) > 0
+	if newest {
+		rw.highSeq = pkt.SequenceNumber
+		if rw.highSeq-rw.baseSeq > rewriteWindow {
+			rw.baseSeq = rw.highSeq - rewriteWindow
+		}
+	}
+
+	pkt.SSRC = rw.ssrc
+	pkt.SequenceNumber += rw.seqOffset
+	pkt.Timestamp += rw.tsOffset
+
+	if newest {
+		rw.lastSeq = pkt.SequenceNumber
+		rw.lastTS = pkt.Timestamp
+		rw.lastArrival = arrival
+	}
+	return true
+}
+
+// SourceSeq maps an outbound sequence number back to the current source's
+// numbering. It reports false for sequence numbers written before the last
+// switch, more than rewriteWindow behind the newest, or not written yet.
+func (rw *RTPRewriter) SourceSeq(seq uint16) (source *PublishedTrack, sourceSeq uint16, ok bool) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	if !rw.started {
+		return nil, 0, false
+	}
+
+	sourceSeq = seq - rw.seqOffset
+	if int16(sourceSeq-rw.baseSeq) < 0 || int16(rw.highSeq-sourceSeq) < 0 {
+		return nil, 0, false
+	}
+	return rw.source, sourceSeq, true
+}
+
+func (rw *RTPRewriter) switchTo(source *PublishedTrack, clockRate uint32, pkt *rtp.Packet, arrival time.Time) {
+	if rw.started {
+		gap := uint32(arrival.Sub(rw.lastArrival).Seconds() * float64(clockRate))
+		if gap == 0 {
+			gap = 1
+		}
+		rw.seqOffset = rw.lastSeq + 1 - pkt.SequenceNumber
+		rw.tsOffset = rw.lastTS + gap - pkt.Timestamp
+	}
+
+	rw.started = true
+	rw.source = source
+	rw.baseSeq = pkt.SequenceNumber
+	rw.highSeq = pkt.SequenceNumber - 1
+}
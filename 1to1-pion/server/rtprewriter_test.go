@@ -0,0 +1,232 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// rewriteStep is one packet fed to the rewriter and what it must produce.
+type rewriteStep struct {
+	src     int // index of the source track
+	rate    uint32
+	seq     uint16
+	ts      uint32
+	at      time.Duration // arrival, relative to the first packet
+	wantOK  bool
+	wantSeq uint16
+	wantTS  uint32
+}
+
+func TestRTPRewriterRewrite(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []rewriteStep
+	}{
+		{
+			name: "in order",
+			steps: []rewriteStep{
+				{0, 48000, 100, 1000, 0, true, 100, 1000},
+				{0, 48000, 101, 1960, 20 * time.Millisecond, true, 101, 1960},
+				{0, 48000, 102, 2920, 40 * time.Millisecond, true, 102, 2920},
+				{0, 48000, 103, 3880, 60 * time.Millisecond, true, 103, 3880},
+			},
+		},
+		{
+			name: "loss gap is preserved",
+			steps: []rewriteStep{
+				{0, 90000, 100, 3000, 0, true, 100, 3000},
+				{0, 90000, 101, 6000, 33 * time.Millisecond, true, 101, 6000},
+				{0, 90000, 104, 15000, 133 * time.Millisecond, true, 104, 15000},
+				{0, 90000, 105, 18000, 166 * time.Millisecond, true, 105, 18000},
+			},
+		},
+		{
+			name: "reordering inside one source",
+			steps: []rewriteStep{
+				{0, 90000, 100, 3000, 0, true, 100, 3000},
+				{0, 90000, 102, 3000, 2 * time.Millisecond, true, 102, 3000},
+				{0, 90000, 101, 3000, 3 * time.Millisecond, true, 101, 3000},
+				{0, 90000, 103, 6000, 33 * time.Millisecond, true, 103, 6000},
+			},
+		},
+		{
+			name: "packet older than the switch is dropped",
+			steps: []rewriteStep{
+				{0, 48000, 100, 1000, 0, true, 100, 1000},
+				{0, 48000, 101, 1960, 20 * time.Millisecond, true, 101, 1960},
+				// Half a second later at 48 kHz: 24000 ticks.
+				{1, 48000, 5000, 700000, 520 * time.Millisecond, true, 102, 25960},
+				{1, 48000, 4999, 699040, 521 * time.Millisecond, false, 0, 0},
+				{1, 48000, 5001, 700960, 540 * time.Millisecond, true, 103, 26920},
+			},
+		},
+		{
+			name: "sequence number wrap",
+			steps: []rewriteStep{
+				{0, 90000, 65534, 3000, 0, true, 65534, 3000},
+				{0, 90000, 65535, 6000, 33 * time.Millisecond, true, 65535, 6000},
+				{0, 90000, 0, 9000, 66 * time.Millisecond, true, 0, 9000},
+				{0, 90000, 1, 12000, 100 * time.Millisecond, true, 1, 12000},
+				{1, 90000, 65535, 500, 600 * time.Millisecond, true, 2, 57000},
+				{1, 90000, 0, 3500, 633 * time.Millisecond, true, 3, 60000},
+			},
+		},
+		{
+			name: "timestamp wrap",
+			steps: []rewriteStep{
+				{0, 48000, 10, 4294966336, 0, true, 10, 4294966336},
+				{0, 48000, 11, 0, 20 * time.Millisecond, true, 11, 0},
+				{0, 48000, 12, 960, 40 * time.Millisecond, true, 12, 960},
+				// The offset itself wraps: 960 + 24000 - 4294967000.
+				{1, 48000, 300, 4294967000, 540 * time.Millisecond, true, 13, 24960},
+				{1, 48000, 301, 664, 560 * time.Millisecond, true, 14, 25920},
+			},
+		},
+		{
+			name: "switches between 48 kHz and 90 kHz sources",
+			steps: []rewriteStep{
+				{0, 48000, 100, 1000, 0, true, 100, 1000},
+				{0, 48000, 101, 1960, 20 * time.Millisecond, true, 101, 1960},
+				// Half a second at 90 kHz: 45000 ticks.
+				{1, 90000, 7000, 123456, 520 * time.Millisecond, true, 102, 46960},
+				{1, 90000, 7001, 126456, 553 * time.Millisecond, true, 103, 49960},
+				// Half a second at 48 kHz: 24000 ticks.
+				{0, 48000, 150, 50000, 1053 * time.Millisecond, true, 104, 73960},
+				{0, 48000, 151, 50960, 1073 * time.Millisecond, true, 105, 74920},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sources := []*PublishedTrack{{}, {}}
+			rw := NewRTPRewriter()
+			start := time.Now()
+
+			for i, step := range tt.steps {
+				pkt := &rtp.Packet{Header: rtp.Header{
+					SSRC:           uint32(1000 + step.src),
+					SequenceNumber: step.seq,
+					Timestamp:      step.ts,
+				}}
+				ok := rw.Rewrite(sources[step.src], step.rate, pkt, start.Add(step.at))
+				if ok != step.wantOK {
+					t.Fatalf("step %d: ok = %t, want %t", i, ok, step.wantOK)
+				}
+				if !ok {
+					continue
+				}
+				if pkt.SequenceNumber != step.wantSeq || pkt.Timestamp != step.wantTS {
+					t.Errorf("step %d: seq %d ts %d, want seq %d ts %d",
+						i, pkt.SequenceNumber, pkt.Timestamp, step.wantSeq, step.wantTS)
+				}
+				if pkt.SSRC != rw.ssrc {
+					t.Errorf("step %d: SSRC %d, want %d", i, pkt.SSRC, rw.ssrc)
+				}
+			}
+		})
+	}
+}
+
+func TestRTPRewriterSourceSeq(t *testing.T) {
+	a, b := &PublishedTrack{}, &PublishedTrack{}
+	rw := NewRTPRewriter()
+	start := time.Now()
+
+	if _, _, ok := rw.SourceSeq(100); ok {
+		t.Fatal("SourceSeq before any packet reported ok")
+	}
+
+	for i, seq := range []uint16{100, 101, 102} {
+		pkt := &rtp.Packet{Header: rtp.Header{SequenceNumber: seq, Timestamp: uint32(i) * 960}}
+		rw.Rewrite(a, 48000, pkt, start.Add(time.Duration(i)*20*time.Millisecond))
+	}
+	pkt := &rtp.Packet{Header: rtp.Header{SequenceNumber: 5000, Timestamp: 7000}}
+	rw.Rewrite(b, 48000, pkt, start.Add(time.Second))
+
+	tests := []struct {
+		name       string
+		seq        uint16
+		wantSource *PublishedTrack
+		wantSeq    uint16
+		wantOK     bool
+	}{
+		{"first packet after the switch", 103, b, 5000, true},
+		{"not written yet", 104, nil, 0, false},
+		{"written before the switch", 101, nil, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source, seq, ok := rw.SourceSeq(tt.seq)
+			if source != tt.wantSource || seq != tt.wantSeq || ok != tt.wantOK {
+				t.Errorf("SourceSeq(%d) = %p, %d, %t; want %p, %d, %t",
+					tt.seq, source, seq, ok, tt.wantSource, tt.wantSeq, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestRTPRewriterSourceSeqBeforeSwitch(t *testing.T) {
+	a := &PublishedTrack{}
+	rw := NewRTPRewriter()
+	start := time.Now()
+	for i, seq := range []uint16{100, 101, 102} {
+		pkt := &rtp.Packet{Header: rtp.Header{SequenceNumber: seq}}
+		rw.Rewrite(a, 90000, pkt, start.Add(time.Duration(i)*33*time.Millisecond))
+	}
+
+	for _, seq := range []uint16{100, 101, 102} {
+		if source, sourceSeq, ok := rw.SourceSeq(seq); !ok || source != a || sourceSeq != seq {
+			t.Errorf("SourceSeq(%d) = %p, %d, %t; want %p, %d, true", seq, source, sourceSeq, ok, a, seq)
+		}
+	}
+	if _, _, ok := rw.SourceSeq(99); ok {
+		t.Error("SourceSeq(99) reported ok for a packet never written")
+	}
+}
+
+// TestRTPRewriterLongRun feeds one source for more than a full sequence
+// number cycle and checks that nothing is dropped, and that late packets are
+// judged against the newest one rather than the switch.
+func TestRTPRewriterLongRun(t *testing.T) {
+	a := &PublishedTrack{}
+	rw := NewRTPRewriter()
+	start := time.Now()
+
+	const packets = 70000
+	var newest uint16
+	for i := 0; i < packets; i++ {
+		seq := uint16(60000 + i)
+		newest = seq
+		pkt := &rtp.Packet{Header: rtp.Header{SequenceNumber: seq, Timestamp: uint32(i) * 960}}
+		if !rw.Rewrite(a, 48000, pkt, start.Add(time.Duration(i)*20*time.Millisecond)) {
+			t.Fatalf("packet %d (seq %d) dropped", i, seq)
+		}
+		if pkt.SequenceNumber != seq || pkt.Timestamp != uint32(i)*960 {
+			t.Fatalf("packet %d: seq %d ts %d, want seq %d ts %d", i, pkt.SequenceNumber, pkt.Timestamp, seq, uint32(i)*960)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		seq    uint16
+		wantOK bool
+	}{
+		{"late inside the window", newest - 100, true},
+		{"late at the edge of the window", newest - rewriteWindow, true},
+		{"late beyond the window", newest - rewriteWindow - 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkt := &rtp.Packet{Header: rtp.Header{SequenceNumber: tt.seq}}
+			if ok := rw.Rewrite(a, 48000, pkt, start.Add(packets*20*time.Millisecond)); ok != tt.wantOK {
+				t.Errorf("Rewrite(seq %d) = %t, want %t", tt.seq, ok, tt.wantOK)
+			}
+			if _, _, ok := rw.SourceSeq(tt.seq); ok != tt.wantOK {
+				t.Errorf("SourceSeq(%d) ok = %t, want %t", tt.seq, ok, tt.wantOK)
+			}
+		})
+	}
+}
@@ -4,66 +4,185 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"sync/atomic"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+const defaultRoomID = "default"
+
 type Server struct {
-	room    *Room
-	counter int32
+	mu       sync.Mutex
+	rooms    map[string]*Room
+	sessions map[string]*session
+	// resources holds the clients connected over WHIP or WHEP by resource
+	// ID.
+	resources map[string]*Client
+
+	cfg      Config
+	upgrader websocket.Upgrader
 }
 
-func NewServer() *Server {
+func NewServer(cfg Config) *Server {
 	return &Server{
-		room: NewRoom(),
+		rooms:     make(map[string]*Room),
+		sessions:  make(map[string]*session),
+		resources: make(map[string]*Client),
+		cfg:       cfg,
+		upgrader: websocket.Upgrader{
+			CheckOrigin: checkOrigin(cfg.AllowedOrigins),
+		},
 	}
 }
 
-func (s *Server) nextID() int {
-	return int(atomic.AddInt32(&s.counter, 1))
+// joinRoom adds the client to the room with the given id, creating the room
+// on first use. The client is assigned the room's next ID.
+func (s *Server) joinRoom(id string, client *Client) (*Room, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	room, ok := s.rooms[id]
+	if !ok {
+		room = NewRoom(id, s.cfg)
+	}
+
+	client.ID = room.nextID()
+	client.Room = room
+	if err := room.Add(client); err != nil {
+		if !ok {
+			room.Close()
+		}
+		return nil, err
+	}
+
+	if !ok {
+		s.rooms[id] = room
+		log.Printf("Room %q created\n", id)
+	}
+	return room, nil
 }
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
+// leaveRoom removes the client from the room and deletes the room once it
+// has no clients left.
+func (s *Server) leaveRoom(room *Room, clientID int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if room.Remove(clientID) && s.rooms[room.ID] == room {
+		delete(s.rooms, room.ID)
+		room.Close()
+		log.Printf("Room %q closed\n", room.ID)
+	}
+}
+
+// authorize returns the identity the request joins roomID with. Without a
+// JWT secret every client is a publisher in the room it asks for; with one,
+// the join token decides and roomID, when given, must match it.
+func (s *Server) authorize(r *http.Request, roomID string) (JoinClaims, error) {
+	if len(s.cfg.JWTSecret) == 0 {
+		if roomID == "" {
+			roomID = defaultRoomID
+		}
+		return JoinClaims{Room: roomID, Role: RolePublisher}, nil
+	}
+
+	claims, err := verifyJoinToken(s.cfg.JWTSecret, bearerToken(r), time.Now())
+	if err != nil {
+		return claims, err
+	}
+	if roomID != "" && roomID != claims.Room {
+		return claims, fmt.Errorf("token is for room %q, not %q", claims.Room, roomID)
+	}
+	return claims, nil
 }
 
 func (s *Server) HandleWS(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+	// A resume token was handed out to an authorized client; it stands in
+	// for the join token.
+	if token := r.URL.Query().Get("resume"); token != "" {
+		conn, err := s.upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		sess, ok := s.resume(token, conn)
+		if !ok {
+			log.Println("Rejected resume with unknown or expired token")
+			rejectResume(conn)
+			return
+		}
+		client := sess.client
+		log.Printf("Client %d resumed in room %q\n", client.ID, client.Room.ID)
+		if err := client.Send("session", Session{ID: client.ID, Token: sess.token}); err != nil {
+			log.Println("session write error:", err)
+		}
+		client.resync()
+		s.serve(sess, conn)
+		return
+	}
+
+	claims, err := s.authorize(r, r.URL.Query().Get("room"))
+	if err != nil {
+		log.Println("Unauthorized websocket:", err)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	conn, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		return
 	}
 
 	client := &Client{
-		ID:   s.nextID(),
+		Name: claims.Name,
+		Role: claims.Role,
 		Conn: conn,
 	}
 
 	client.readyChan = make(chan struct{})
 
-	if err := s.room.Add(client); err != nil {
+	room, err := s.joinRoom(claims.Room, client)
+	if err != nil {
+		log.Printf("Client rejected from room %q: %v\n", claims.Room, err)
+		conn.WriteJSON(MessageOut{
+			Type: "error",
+			Data: ErrorMessage{Code: errCodeJoinRejected, Message: err.Error()},
+		})
 		conn.Close()
-		http.Error(w, "room full", http.StatusForbidden)
 		return
 	}
 
-	pc, err := NewPeer(client, s.room)
+	pc, err := NewPeer(client, room)
 	if err != nil {
+		s.leaveRoom(room, client.ID)
+		client.Close()
 		conn.Close()
 		return
 	}
-	client.PC = pc
 
-	log.Printf("Client %d connected\n", client.ID)
-
-	defer func() {
-		log.Printf("Client %d disconnected\n", client.ID)
+	sess, err := s.register(client, conn)
+	if err != nil {
+		log.Println("session token error:", err)
 		pc.Close()
-		s.room.Remove(client.ID)
+		s.leaveRoom(room, client.ID)
+		client.Close()
 		conn.Close()
-	}()
+		return
+	}
+	if err := client.Send("session", Session{ID: client.ID, Token: sess.token}); err != nil {
+		log.Println("session write error:", err)
+	}
+	room.Attach(client, pc)
+
+	log.Printf("Client %d (%s %q) connected to room %q\n", client.ID, client.Role, client.Name, room.ID)
+
+	s.serve(sess, conn)
+}
+
+// serve reads signaling messages from conn until it closes.
+func (s *Server) serve(sess *session, conn *websocket.Conn) {
+	defer s.detach(sess, conn)
 
 	for {
 		_, msg, err := conn.ReadMessage()
@@ -71,6 +190,9 @@ func (s *Server) HandleWS(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			return
 		}
-		s.handleSignal(client, msg)
+		if err := s.handleSignal(sess.client, msg); err != nil && !sess.client.replyError(err) {
+			s.expire(sess, conn)
+			return
+		}
 	}
 }
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// closeSessionExpired is the websocket close code sent to a client whose
+// resume token is unknown or has expired. The client has to join afresh.
+const closeSessionExpired = 4001
+
+// session keeps a client's slot in its room while its websocket is away.
+// The PeerConnection and every subscription stay in place, so a client that
+// reconnects within the resume timeout carries on where it left off.
+type session struct {
+	token  string
+	client *Client
+	// conn is the websocket currently serving the client. A read loop that
+	// ends on any other websocket has been superseded by a resume.
+	conn  *websocket.Conn
+	timer *time.Timer
+	ended bool
+}
+
+// newToken returns a random token that cannot be guessed.
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// register hands the client a resume token for its websocket.
+func (s *Server) register(c *Client, conn *websocket.Conn) (*session, error) {
+	token, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess := &session{
+		token:  token,
+		client: c,
+		conn:   conn,
+	}
+	s.sessions[token] = sess
+	return sess, nil
+}
+
+// resume moves the session with the given token onto conn. It fails when the
+// token is unknown or the session has already ended.
+func (s *Server) resume(token string, conn *websocket.Conn) (*session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess, ok := s.sessions[token]
+	if !ok || sess.ended {
+		return nil, false
+	}
+	if sess.timer != nil {
+		sess.timer.Stop()
+		sess.timer = nil
+	}
+	sess.conn = conn
+	sess.client.setConn(conn)
+	return sess, true
+}
+
+// detach is called when the read loop on conn ends. The client keeps its
+// slot for the resume timeout unless another websocket has already taken
+// over the session.
+func (s *Server) detach(sess *session, conn *websocket.Conn) {
+	s.mu.Lock()
+	if sess.ended || sess.conn != conn {
+		s.mu.Unlock()
+		return
+	}
+	timeout := s.cfg.ResumeTimeout
+	if timeout > 0 {
+		log.Printf("Client %d lost its websocket, holding slot for %v\n", sess.client.ID, timeout)
+		sess.timer = time.AfterFunc(timeout, func() {
+			s.expire(sess, conn)
+		})
+		s.mu.Unlock()
+		return
+	}
+	s.mu.Unlock()
+
+	s.expire(sess, conn)
+}
+
+// expire ends the session if it is still waiting for a resume on conn. A nil
+// conn ends it whichever websocket is serving it.
+func (s *Server) expire(sess *session, conn *websocket.Conn) {
+	s.mu.Lock()
+	if sess.ended || (conn != nil && sess.conn != conn) {
+		s.mu.Unlock()
+		return
+	}
+	sess.ended = true
+	if sess.timer != nil {
+		sess.timer.Stop()
+	}
+	conn = sess.conn
+	delete(s.sessions, sess.token)
+	s.mu.Unlock()
+
+	c := sess.client
+	log.Printf("Client %d disconnected from room %q\n", c.ID, c.Room.ID)
+	c.closePeer()
+	s.leaveRoom(c.Room, c.ID)
+	c.Close()
+	conn.Close()
+}
+
+// rejectResume tells a client that its session is gone and closes conn.
+func rejectResume(conn *websocket.Conn) {
+	msg := websocket.FormatCloseMessage(closeSessionExpired, "session expired")
+	conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	conn.Close()
+}
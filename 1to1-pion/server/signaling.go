@@ -2,18 +2,104 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 
-	"github.com/gorilla/websocket"
 	"github.com/pion/webrtc/v4"
 )
 
-func (s *Server) handleSignal(c *Client, raw []byte) {
+// Codes sent in "error" messages.
+const (
+	// errCodeBadMessage: the message or its payload could not be decoded.
+	errCodeBadMessage = "bad-message"
+	// errCodeUnknownType: the message type is not one the server handles.
+	errCodeUnknownType = "unknown-type"
+	// errCodeNegotiation: an offer or answer was rejected.
+	errCodeNegotiation = "negotiation-failed"
+	// errCodeBadCandidate: an ICE candidate could not be added.
+	errCodeBadCandidate = "bad-candidate"
+	// errCodeBadRequest: a select-source, set-layer or moderator request was
+	// refused.
+	errCodeBadRequest = "bad-request"
+	// errCodeForbidden: the client's role does not allow the request.
+	errCodeForbidden = "forbidden"
+	// errCodeJoinRejected: the room is full or locked.
+	errCodeJoinRejected = "join-rejected"
+)
+
+// signalError is a failed signaling message, reported back to the client
+// that sent it. Fatal errors leave the session unusable and the client is
+// disconnected after the reply.
+type signalError struct {
+	Code  string
+	Err   error
+	Fatal bool
+}
+
+func (e *signalError) Error() string {
+	return e.Code + ": " + e.Err.Error()
+}
+
+func (e *signalError) Unwrap() error {
+	return e.Err
+}
+
+func badMessage(msgType string, err error) error {
+	return &signalError{Code: errCodeBadMessage, Err: fmt.Errorf("%s: %w", msgType, err)}
+}
+
+// negotiationError reports a failed offer/answer exchange. pion cannot roll
+// a description back, so the session survives only where the failure left
+// nothing half applied: in the stable state the client can simply negotiate
+// again, and a server offer it failed to answer is sent once more for it to
+// answer. Anything else, a second failed answer included, is fatal. It must
+// be called with negMux held.
+func (c *Client) negotiationError(err error) error {
+	fatal := false
+	switch c.PC.SignalingState() {
+	case webrtc.SignalingStateStable:
+	case webrtc.SignalingStateHaveLocalOffer:
+		if c.offerResent {
+			fatal = true
+			break
+		}
+		c.offerResent = true
+		log.Println("resending offer to client", c.ID)
+		if err := c.Send("offer", c.PC.LocalDescription()); err != nil {
+			log.Println("offer write error:", err)
+		}
+	default:
+		fatal = true
+	}
+	return &signalError{
+		Code:  errCodeNegotiation,
+		Err:   err,
+		Fatal: fatal,
+	}
+}
+
+// replyError sends err to the client as an "error" message. It reports
+// whether the session can carry on.
+func (c *Client) replyError(err error) bool {
+	var se *signalError
+	if !errors.As(err, &se) {
+		se = &signalError{Code: errCodeBadMessage, Err: err}
+	}
+	log.Printf("signaling error from client %d: %v\n", c.ID, se)
+
+	if err := c.Send("error", ErrorMessage{Code: se.Code, Message: se.Err.Error()}); err != nil {
+		log.Println("error write error:", err)
+	}
+	return !se.Fatal
+}
+
+// handleSignal handles one message from the client. A returned error is
+// reported to the client with replyError.
+func (s *Server) handleSignal(c *Client, raw []byte) error {
 	var msg Message
 	if err := json.Unmarshal(raw, &msg); err != nil {
-		fmt.Println("message unmarshaling failed-", err)
-		return
+		return badMessage("message", err)
 	}
 
 	fmt.Println("handling message-", msg.Type)
@@ -24,47 +110,97 @@ func (s *Server) handleSignal(c *Client, raw []byte) {
 		log.Println("offer received")
 		var offer webrtc.SessionDescription
 		if err := json.Unmarshal(msg.Data, &offer); err != nil {
-			log.Println("failed to unmarshal offer:", err)
-			return
+			return badMessage(msg.Type, err)
 		}
-		if setErr := c.PC.SetRemoteDescription(offer); setErr != nil {
-			panic(setErr)
+		return c.handleOffer(offer)
+
+	case "answer":
+		log.Println("answer received")
+		var answer webrtc.SessionDescription
+		if err := json.Unmarshal(msg.Data, &answer); err != nil {
+			return badMessage(msg.Type, err)
 		}
+		return c.handleAnswer(answer)
 
-		answer, err := c.PC.CreateAnswer(nil)
-	
-		if err != nil {
-			log.Fatalln("err in creating answer-", err)
+	case "select-source":
+		var sel SelectSource
+		if err := json.Unmarshal(msg.Data, &sel); err != nil {
+			return badMessage(msg.Type, err)
 		}
-		if setErr := c.PC.SetLocalDescription(answer); setErr != nil {
-			panic(setErr)
+		if err := c.Room.SelectSource(c, sel.ID, sel.Kind); err != nil {
+			return &signalError{Code: errCodeBadRequest, Err: err}
 		}
 
-		ansMesg := MessageOut{
-			Type: "answer",
-			Data: map[string]string{
-				"type": "answer",
-				"sdp":  answer.SDP,
-			},
+	case "set-layer":
+		var layer SetLayer
+		if err := json.Unmarshal(msg.Data, &layer); err != nil {
+			return badMessage(msg.Type, err)
+		}
+		if err := c.Room.SetLayerPreference(c, layer.ID, layer.RID); err != nil {
+			return &signalError{Code: errCodeBadRequest, Err: err}
 		}
 
-		ansMesgBytes, _ := json.Marshal(ansMesg)
+	case "mute", "kick", "lock", "record":
+		if c.Role != RoleModerator {
+			return &signalError{Code: errCodeForbidden, Err: fmt.Errorf("%s: %w", msg.Type, errNotModerator)}
+		}
+		return s.handleModeration(c, msg)
 
-		fmt.Println("sending answer message")
-		c.clientMux.Lock()
-		defer c.clientMux.Unlock()
-		c.Conn.WriteMessage(websocket.TextMessage, ansMesgBytes)
+	case "restart-ice":
+		log.Println("ICE restart requested by client", c.ID)
+		c.restartICE()
 
 	case "ice":
 		var candidate webrtc.ICECandidateInit
-		err := json.Unmarshal(msg.Data, &candidate)
-		if err != nil {
-			log.Printf("Error unmarshaling ICE candidate: %v", err)
-			return
+		if err := json.Unmarshal(msg.Data, &candidate); err != nil {
+			return badMessage(msg.Type, err)
 		}
-		if err := c.PC.AddICECandidate(candidate); err != nil {
-			log.Fatal("err in adding ice candidate-", err)
-			panic(err)
+		if err := c.addICECandidate(candidate); err != nil {
+			return &signalError{Code: errCodeBadCandidate, Err: err}
 		}
+
+	default:
+		return &signalError{Code: errCodeUnknownType, Err: fmt.Errorf("unknown message type %q", msg.Type)}
+	}
+	return nil
+}
+
+// handleModeration carries out a moderator's mute, kick, lock or record
+// request.
+func (s *Server) handleModeration(c *Client, msg Message) error {
+	var err error
+	switch msg.Type {
+	case "mute":
+		var m Mute
+		if err := json.Unmarshal(msg.Data, &m); err != nil {
+			return badMessage(msg.Type, err)
+		}
+		err = c.Room.Mute(c, m)
+
+	case "kick":
+		var k Kick
+		if err := json.Unmarshal(msg.Data, &k); err != nil {
+			return badMessage(msg.Type, err)
+		}
+		err = s.kick(c, k.ID)
+
+	case "lock":
+		var l Lock
+		if err := json.Unmarshal(msg.Data, &l); err != nil {
+			return badMessage(msg.Type, err)
+		}
+		c.Room.Lock(c, l.Locked)
+
+	case "record":
+		var rec Record
+		if err := json.Unmarshal(msg.Data, &rec); err != nil {
+			return badMessage(msg.Type, err)
+		}
+		err = c.Room.SetRecording(c, rec)
+	}
+
+	if err != nil {
+		return &signalError{Code: errCodeBadRequest, Err: err}
 	}
+	return nil
 }
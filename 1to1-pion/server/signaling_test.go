@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// newTestClient joins a client without a websocket to a fresh room, the way
+// HandleWS does, and tears both down when the test ends.
+func newTestClient(t *testing.T, role Role) (*Server, *Client) {
+	t.Helper()
+
+	s := NewServer(Config{Codecs: []string{"opus", "vp8"}})
+	c := &Client{Role: role, readyChan: make(chan struct{})}
+	room, err := s.joinRoom("test", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := NewPeer(c, room)
+	if err != nil {
+		t.Fatal(err)
+	}
+	room.Attach(c, pc)
+
+	t.Cleanup(func() {
+		pc.Close()
+		s.leaveRoom(room, c.ID)
+		c.Close()
+	})
+	return s, c
+}
+
+// sendServerOffer puts the client's PeerConnection in have-local-offer, as
+// a renegotiation does.
+func sendServerOffer(t *testing.T, c *Client) {
+	t.Helper()
+	c.negMux.Lock()
+	defer c.negMux.Unlock()
+	c.negotiated = true
+	c.sendOfferLocked(nil)
+	if state := c.PC.SignalingState(); state != webrtc.SignalingStateHaveLocalOffer {
+		t.Fatalf("signaling state %s after server offer", state)
+	}
+}
+
+func TestHandleSignalMalformed(t *testing.T) {
+	tests := []struct {
+		name  string
+		role  Role
+		setup func(*testing.T, *Client)
+		raw   string
+		// wantCode is empty when the message must be accepted.
+		wantCode  string
+		wantFatal bool
+		wantState webrtc.SignalingState
+	}{
+		{name: "not JSON", raw: `{"type":`, wantCode: errCodeBadMessage},
+		{name: "offer without data", raw: `{"type":"offer"}`, wantCode: errCodeBadMessage},
+		{name: "offer with null data", raw: `{"type":"offer","data":null}`, wantCode: errCodeNegotiation},
+		{name: "offer with a number", raw: `{"type":"offer","data":42}`, wantCode: errCodeBadMessage},
+		{name: "answer with a string", raw: `{"type":"answer","data":"v=0"}`, wantCode: errCodeBadMessage},
+		{name: "ice with an array", raw: `{"type":"ice","data":[]}`, wantCode: errCodeBadMessage},
+		{name: "select-source with a string id", raw: `{"type":"select-source","data":{"id":"two"}}`, wantCode: errCodeBadMessage},
+		{name: "set-layer with a bool", raw: `{"type":"set-layer","data":true}`, wantCode: errCodeBadMessage},
+		{name: "mute with a string", role: RoleModerator, raw: `{"type":"mute","data":"loud"}`, wantCode: errCodeBadMessage},
+		{name: "mute from a publisher", raw: `{"type":"mute","data":{"id":1}}`, wantCode: errCodeForbidden},
+		{name: "unknown type", raw: `{"type":"hello","data":{}}`, wantCode: errCodeUnknownType},
+		{name: "unparsable SDP", raw: `{"type":"offer","data":{"type":"offer","sdp":"not sdp"}}`, wantCode: errCodeNegotiation},
+		{name: "answer in stable state", raw: `{"type":"answer","data":{"type":"answer","sdp":"v=0"}}`},
+		{
+			name:     "ice before a remote description",
+			raw:      `{"type":"ice","data":{"candidate":"candidate:1 1 udp 2130706431 192.0.2.1 50000 typ host","sdpMid":"0"}}`,
+			wantCode: errCodeBadCandidate,
+		},
+		{
+			// The pending server offer survives, so the client can still
+			// answer it.
+			name:      "bad answer to a server offer",
+			setup:     sendServerOffer,
+			raw:       `{"type":"answer","data":{"type":"answer","sdp":"not sdp"}}`,
+			wantCode:  errCodeNegotiation,
+			wantState: webrtc.SignalingStateHaveLocalOffer,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			role := tt.role
+			if role == "" {
+				role = RolePublisher
+			}
+			s, c := newTestClient(t, role)
+			if tt.setup != nil {
+				tt.setup(t, c)
+			}
+
+			defer func() {
+				if r := recover(); r != nil {
+					t.Fatalf("handleSignal panicked: %v", r)
+				}
+			}()
+			err := s.handleSignal(c, []byte(tt.raw))
+
+			if tt.wantCode == "" {
+				if err != nil {
+					t.Fatalf("handleSignal = %v, want nil", err)
+				}
+				return
+			}
+			var se *signalError
+			if !errors.As(err, &se) {
+				t.Fatalf("handleSignal = %v, want a signalError", err)
+			}
+			if se.Code != tt.wantCode || se.Fatal != tt.wantFatal {
+				t.Errorf("handleSignal = %q fatal=%t (%v), want %q fatal=%t",
+					se.Code, se.Fatal, se.Err, tt.wantCode, tt.wantFatal)
+			}
+
+			wantState := tt.wantState
+			if wantState == webrtc.SignalingStateUnknown {
+				wantState = webrtc.SignalingStateStable
+			}
+			if state := c.PC.SignalingState(); state != wantState {
+				t.Errorf("signaling state %s, want %s", state, wantState)
+			}
+		})
+	}
+}
+
+// TestBadAnswerRecovery sends a malformed answer to a server offer, then a
+// colliding client offer, and checks that the resent server offer can still
+// be answered; a second malformed answer ends the session.
+func TestBadAnswerRecovery(t *testing.T) {
+	s, c := newTestClient(t, RolePublisher)
+	sendServerOffer(t, c)
+	offer := *c.PC.LocalDescription()
+
+	signal := func(msgType string, data any) error {
+		b, err := json.Marshal(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, _ := json.Marshal(Message{Type: msgType, Data: b})
+		return s.handleSignal(c, raw)
+	}
+	badAnswer := webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: "not sdp"}
+
+	var se *signalError
+	if err := signal("answer", badAnswer); !errors.As(err, &se) || se.Fatal {
+		t.Fatalf("first bad answer = %v, want a non-fatal signalError", err)
+	}
+	if state := c.PC.SignalingState(); state != webrtc.SignalingStateHaveLocalOffer {
+		t.Fatalf("signaling state %s after a bad answer, want have-local-offer", state)
+	}
+
+	// The client's own offer collides with the pending server offer.
+	peer, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	if _, err := peer.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio); err != nil {
+		t.Fatal(err)
+	}
+	clientOffer, err := peer.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := signal("offer", clientOffer); err != nil {
+		t.Fatalf("colliding offer = %v, want it ignored", err)
+	}
+
+	// The client, as the polite peer, answers the server's offer instead.
+	if err := peer.SetRemoteDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	answer, err := peer.CreateAnswer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := signal("answer", answer); err != nil {
+		t.Fatalf("answer to the resent offer = %v", err)
+	}
+	if state := c.PC.SignalingState(); state != webrtc.SignalingStateStable {
+		t.Fatalf("signaling state %s after a good answer, want stable", state)
+	}
+
+	// A client that cannot answer at all is disconnected.
+	sendServerOffer(t, c)
+	signal("answer", badAnswer)
+	if err := signal("answer", badAnswer); !errors.As(err, &se) || !se.Fatal {
+		t.Fatalf("second bad answer = %v, want a fatal signalError", err)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"log"
+	"slices"
+	"sync"
+	"time"
+)
+
+// layerSelectInterval limits how often a subscriber's simulcast layers are
+// re-evaluated against its bandwidth estimate.
+const layerSelectInterval = time.Second
+
+// simulcastGroup ties together the layers of one simulcast track. Each
+// subscriber gets a single outbound track for the group, fed by a
+// MediaSwitcher that moves between layers on keyframes.
+type simulcastGroup struct {
+	mu     sync.Mutex
+	layers []*PublishedTrack
+	subs   map[int]*subscription
+	// prefs holds each subscriber's explicitly chosen RID.
+	prefs map[int]string
+}
+
+func newSimulcastGroup() *simulcastGroup {
+	return &simulcastGroup{
+		subs:  make(map[int]*subscription),
+		prefs: make(map[int]string),
+	}
+}
+
+func (g *simulcastGroup) addLayer(t *PublishedTrack) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	t.group = g
+	g.layers = append(g.layers, t)
+}
+
+func (g *simulcastGroup) removeLayer(t *PublishedTrack) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if i := slices.Index(g.layers, t); i >= 0 {
+		g.layers = slices.Delete(g.layers, i, i+1)
+	}
+}
+
+// RIDs lists the group's layers.
+func (g *simulcastGroup) RIDs() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	rids := make([]string, 0, len(g.layers))
+	for _, l := range g.layers {
+		rids = append(rids, l.RID)
+	}
+	return rids
+}
+
+func (g *simulcastGroup) hasLayer(rid string) bool {
+	return slices.Contains(g.RIDs(), rid)
+}
+
+// subscribe registers layer t for sub, creating sub's outbound track for the
+// group the first time one of its layers is subscribed.
+func (g *simulcastGroup) subscribe(t *PublishedTrack, sub *Client) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	s, ok := g.subs[sub.ID]
+	if !ok {
+		var err error
+		if s, err = newSubscription(t, sub); err != nil {
+			return err
+		}
+		s.layers = NewMediaSwitcher(s.out)
+		s.layers.SwitchTo(t)
+		if s.sender != nil {
+			go s.layers.readRTCP(s.sender)
+		}
+		g.subs[sub.ID] = s
+	}
+
+	t.addSub(sub.ID, s)
+	return nil
+}
+
+// release drops sub's outbound track once none of the group's layers feeds
+// it any more. It returns the subscription when it was dropped.
+func (g *simulcastGroup) release(subID int) *subscription {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, l := range g.layers {
+		if l.hasSub(subID) {
+			return nil
+		}
+	}
+	s := g.subs[subID]
+	delete(g.subs, subID)
+	delete(g.prefs, subID)
+	return s
+}
+
+func (g *simulcastGroup) sub(subID int) *subscription {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.subs[subID]
+}
+
+func (g *simulcastGroup) setPreference(subID int, rid string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if rid == "" {
+		delete(g.prefs, subID)
+	} else {
+		g.prefs[subID] = rid
+	}
+}
+
+// selectLayer picks the layer for one subscriber: its preferred layer if it
+// set one, otherwise the highest layer whose measured bitrate fits budget,
+// falling back to the lowest layer.
+func (g *simulcastGroup) selectLayer(subID int, budget int) *PublishedTrack {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if len(g.layers) == 0 {
+		return nil
+	}
+
+	if rid, ok := g.prefs[subID]; ok {
+		for _, l := range g.layers {
+			if l.RID == rid {
+				return l
+			}
+		}
+	}
+
+	layers := slices.Clone(g.layers)
+	slices.SortFunc(layers, func(a, b *PublishedTrack) int {
+		return a.Bitrate() - b.Bitrate()
+	})
+
+	best := layers[0]
+	for _, l := range layers[1:] {
+		if l.Bitrate() <= budget {
+			best = l
+		}
+	}
+	return best
+}
+
+// applyLayer moves sub onto the layer selected for budget. The subscriber's
+// main video switcher follows along when it shows this group.
+func (g *simulcastGroup) applyLayer(sub *Client, budget int) {
+	s := g.sub(sub.ID)
+	target := g.selectLayer(sub.ID, budget)
+	if s == nil || target == nil || s.layers.Target() == target {
+		return
+	}
+
+	log.Printf("client %d switching to layer %q of client %d\n", sub.ID, target.RID, target.Publisher.ID)
+	s.layers.SwitchTo(target)
+	if main := sub.VideoSwitcher.Target(); main != nil && main.group == g {
+		sub.VideoSwitcher.SwitchTo(target)
+	}
+}
+
+// rateMeter measures a bitrate over one-second windows.
+type rateMeter struct {
+	mu          sync.Mutex
+	windowStart time.Time
+	bytes       int
+	bitrate     int
+}
+
+func (m *rateMeter) Add(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if m.windowStart.IsZero() {
+		m.windowStart = now
+	}
+	if elapsed := now.Sub(m.windowStart); elapsed >= time.Second {
+		m.bitrate = int(float64(m.bytes*8) / elapsed.Seconds())
+		m.bytes = 0
+		m.windowStart = now
+	}
+	m.bytes += n
+}
+
+// Bitrate returns the bitrate of the last full window in bits per second.
+func (m *rateMeter) Bitrate() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.bitrate
+}
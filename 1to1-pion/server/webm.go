@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// Matroska element IDs used by webmWriter.
+const (
+	idEBML               = 0x1A45DFA3
+	idEBMLVersion        = 0x4286
+	idEBMLReadVersion    = 0x42F7
+	idEBMLMaxIDLength    = 0x42F2
+	idEBMLMaxSizeLength  = 0x42F3
+	idDocType            = 0x4282
+	idDocTypeVersion     = 0x4287
+	idDocTypeReadVersion = 0x4285
+
+	idSegment       = 0x18538067
+	idInfo          = 0x1549A966
+	idTimecodeScale = 0x2AD7B1
+	idMuxingApp     = 0x4D80
+	idWritingApp    = 0x5741
+
+	idTracks            = 0x1654AE6B
+	idTrackEntry        = 0xAE
+	idTrackNumber       = 0xD7
+	idTrackUID          = 0x73C5
+	idTrackType         = 0x83
+	idCodecID           = 0x86
+	idCodecPrivate      = 0x63A2
+	idVideo             = 0xE0
+	idPixelWidth        = 0xB0
+	idPixelHeight       = 0xBA
+	idAudio             = 0xE1
+	idSamplingFrequency = 0xB5
+	idChannels          = 0x9F
+
+	idCluster     = 0x1F43B675
+	idTimecode    = 0xE7
+	idSimpleBlock = 0xA3
+)
+
+const (
+	// ebmlUnknownSize marks the segment as live: its length is not known
+	// while it is being written.
+	ebmlUnknownSize = 0x01FFFFFFFFFFFFFF
+
+	// clusterMinDuration and clusterMaxDuration bound the length of a
+	// cluster, in milliseconds. Clusters start on video keyframes when
+	// possible so that players can seek to them.
+	clusterMinDuration = 1000
+	clusterMaxDuration = 5000
+)
+
+// webmTrack describes one track of a WebM file.
+type webmTrack struct {
+	Number       uint64
+	Video        bool
+	CodecID      string
+	CodecPrivate []byte
+
+	Width, Height int
+
+	SampleRate float64
+	Channels   int
+}
+
+// webmWriter writes a live WebM file with millisecond timestamps. Blocks are
+// collected into a cluster in memory and the cluster is written once it is
+// complete, so a file cut short still plays up to its last cluster.
+type webmWriter struct {
+	w io.WriteCloser
+	// videoTrack is the number of the video track, whose keyframes start
+	// new clusters.
+	videoTrack uint64
+
+	cluster     bytes.Buffer
+	clusterTime int64
+	clusterOpen bool
+}
+
+func newWebMWriter(w io.WriteCloser, tracks []webmTrack) (*webmWriter, error) {
+	var header bytes.Buffer
+	header.Write(ebmlElement(idEBML, concat(
+		ebmlUint(idEBMLVersion, 1),
+		ebmlUint(idEBMLReadVersion, 1),
+		ebmlUint(idEBMLMaxIDLength, 4),
+		ebmlUint(idEBMLMaxSizeLength, 8),
+		ebmlString(idDocType, "webm"),
+		ebmlUint(idDocTypeVersion, 4),
+		ebmlUint(idDocTypeReadVersion, 2),
+	)))
+
+	header.Write(ebmlID(idSegment))
+	header.Write(ebmlSize(ebmlUnknownSize))
+	header.Write(ebmlElement(idInfo, concat(
+		ebmlUint(idTimecodeScale, 1_000_000),
+		ebmlString(idMuxingApp, "1to1-pion"),
+		ebmlString(idWritingApp, "1to1-pion"),
+	)))
+
+	ww := &webmWriter{w: w}
+	var entries [][]byte
+	for _, t := range tracks {
+		entry := [][]byte{
+			ebmlUint(idTrackNumber, t.Number),
+			ebmlUint(idTrackUID, t.Number),
+			ebmlString(idCodecID, t.CodecID),
+		}
+		if t.CodecPrivate != nil {
+			entry = append(entry, ebmlElement(idCodecPrivate, t.CodecPrivate))
+		}
+		if t.Video {
+			ww.videoTrack = t.Number
+			entry = append(entry,
+				ebmlUint(idTrackType, 1),
+				ebmlElement(idVideo, concat(
+					ebmlUint(idPixelWidth, uint64(t.Width)),
+					ebmlUint(idPixelHeight, uint64(t.Height)),
+				)),
+			)
+		} else {
+			entry = append(entry,
+				ebmlUint(idTrackType, 2),
+				ebmlElement(idAudio, concat(
+					ebmlFloat(idSamplingFrequency, t.SampleRate),
+					ebmlUint(idChannels, uint64(t.Channels)),
+				)),
+			)
+		}
+		entries = append(entries, ebmlElement(idTrackEntry, concat(entry...)))
+	}
+	header.Write(ebmlElement(idTracks, concat(entries...)))
+
+	if _, err := w.Write(header.Bytes()); err != nil {
+		return nil, err
+	}
+	return ww, nil
+}
+
+// WriteBlock adds a frame to the file. timestamp is in milliseconds from the
+// start of the recording.
+func (ww *webmWriter) WriteBlock(track uint64, keyframe bool, timestamp int64, data []byte) error {
+	elapsed := timestamp - ww.clusterTime
+	if !ww.clusterOpen ||
+		(keyframe && track == ww.videoTrack && elapsed >= clusterMinDuration) ||
+		elapsed >= clusterMaxDuration || elapsed < math.MinInt16 {
+		if err := ww.flushCluster(); err != nil {
+			return err
+		}
+		ww.clusterOpen = true
+		ww.clusterTime = timestamp
+		ww.cluster.Write(ebmlUint(idTimecode, uint64(timestamp)))
+		elapsed = 0
+	}
+
+	block := make([]byte, 0, len(data)+4)
+	block = append(block, ebmlSize(track)...)
+	block = binary.BigEndian.AppendUint16(block, uint16(int16(elapsed)))
+	var flags byte
+	if keyframe {
+		flags |= 0x80
+	}
+	block = append(block, flags)
+	block = append(block, data...)
+	ww.cluster.Write(ebmlElement(idSimpleBlock, block))
+	return nil
+}
+
+func (ww *webmWriter) flushCluster() error {
+	if !ww.clusterOpen {
+		return nil
+	}
+	ww.clusterOpen = false
+	_, err := ww.w.Write(ebmlElement(idCluster, ww.cluster.Bytes()))
+	ww.cluster.Reset()
+	return err
+}
+
+// Close writes the last cluster and closes the file.
+func (ww *webmWriter) Close() error {
+	err := ww.flushCluster()
+	if cerr := ww.w.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// opusHead is the Opus identification header Matroska expects as the codec
+// private data of an A_OPUS track.
+func opusHead(channels int, sampleRate uint32) []byte {
+	head := []byte("OpusHead")
+	head = append(head, 1, byte(channels))
+	head = binary.LittleEndian.AppendUint16(head, 0) // pre-skip
+	head = binary.LittleEndian.AppendUint32(head, sampleRate)
+	head = binary.LittleEndian.AppendUint16(head, 0) // output gain
+	return append(head, 0)                           // channel mapping family
+}
+
+func ebmlElement(id uint32, payload []byte) []byte {
+	b := ebmlID(id)
+	b = append(b, ebmlSize(uint64(len(payload)))...)
+	return append(b, payload...)
+}
+
+func ebmlUint(id uint32, v uint64) []byte {
+	n := 1
+	for n < 8 && v>>(8*n) != 0 {
+		n++
+	}
+	b := make([]byte, n)
+	for i := range b {
+		b[n-1-i] = byte(v >> (8 * i))
+	}
+	return ebmlElement(id, b)
+}
+
+func ebmlFloat(id uint32, f float64) []byte {
+	return ebmlElement(id, binary.BigEndian.AppendUint64(nil, math.Float64bits(f)))
+}
+
+func ebmlString(id uint32, s string) []byte {
+	return ebmlElement(id, []byte(s))
+}
+
+// ebmlID encodes an element ID, which already carries its length marker.
+func ebmlID(id uint32) []byte {
+	switch {
+	case id > 0xFFFFFF:
+		return []byte{byte(id >> 24), byte(id >> 16), byte(id >> 8), byte(id)}
+	case id > 0xFFFF:
+		return []byte{byte(id >> 16), byte(id >> 8), byte(id)}
+	case id > 0xFF:
+		return []byte{byte(id >> 8), byte(id)}
+	}
+	return []byte{byte(id)}
+}
+
+// ebmlSize encodes a variable-length size in as few bytes as possible.
+func ebmlSize(v uint64) []byte {
+	if v == ebmlUnknownSize {
+		return []byte{0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+	}
+	n := 1
+	// All ones is reserved for an unknown size.
+	for n < 8 && v >= 1<<(7*n)-1 {
+		n++
+	}
+	b := make([]byte, n)
+	v |= 1 << (7 * n)
+	for i := range b {
+		b[n-1-i] = byte(v >> (8 * i))
+	}
+	return b
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
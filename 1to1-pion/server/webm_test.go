@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestEBMLSize(t *testing.T) {
+	tests := []struct {
+		v    uint64
+		want []byte
+	}{
+		{0, []byte{0x80}},
+		{1, []byte{0x81}},
+		{126, []byte{0xFE}},
+		// 0x7F in one byte would be all ones, which means unknown.
+		{127, []byte{0x40, 0x7F}},
+		{128, []byte{0x40, 0x80}},
+		{16382, []byte{0x7F, 0xFE}},
+		{16383, []byte{0x20, 0x3F, 0xFF}},
+		{1<<56 - 2, []byte{0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFE}},
+		{ebmlUnknownSize, []byte{0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}},
+	}
+	for _, tt := range tests {
+		if got := ebmlSize(tt.v); !bytes.Equal(got, tt.want) {
+			t.Errorf("ebmlSize(%d) = % X, want % X", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestEBMLUint(t *testing.T) {
+	tests := []struct {
+		id   uint32
+		v    uint64
+		want []byte
+	}{
+		{idTrackNumber, 0, []byte{0xD7, 0x81, 0x00}},
+		{idTrackNumber, 1, []byte{0xD7, 0x81, 0x01}},
+		{idTrackNumber, 256, []byte{0xD7, 0x82, 0x01, 0x00}},
+		{idTimecodeScale, 1_000_000, []byte{0x2A, 0xD7, 0xB1, 0x83, 0x0F, 0x42, 0x40}},
+		{idTimecode, 1<<64 - 1, []byte{0xE7, 0x88, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}},
+	}
+	for _, tt := range tests {
+		if got := ebmlUint(tt.id, tt.v); !bytes.Equal(got, tt.want) {
+			t.Errorf("ebmlUint(%#x, %d) = % X, want % X", tt.id, tt.v, got, tt.want)
+		}
+	}
+}
+
+// bufferCloser collects a webmWriter's output in memory.
+type bufferCloser struct {
+	bytes.Buffer
+}
+
+func (*bufferCloser) Close() error { return nil }
+
+func TestWebMWriterSimpleBlock(t *testing.T) {
+	var out bufferCloser
+	ww, err := newWebMWriter(&out, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+
+	ww.WriteBlock(mixedAudioTrack, false, 1000, []byte{0xAA})
+	ww.WriteBlock(mixedAudioTrack, true, 1300, []byte{0xBB})
+	ww.WriteBlock(mixedAudioTrack, false, 900, []byte{0xCC})
+	if err := ww.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := concat(
+		[]byte{0x1F, 0x43, 0xB6, 0x75, 0x99}, // Cluster, 25 bytes
+		[]byte{0xE7, 0x82, 0x03, 0xE8},       // Timecode 1000
+		// SimpleBlock: track 2, relative timecode, flags, frame.
+		[]byte{0xA3, 0x85, 0x82, 0x00, 0x00, 0x00, 0xAA},
+		[]byte{0xA3, 0x85, 0x82, 0x01, 0x2C, 0x80, 0xBB},
+		[]byte{0xA3, 0x85, 0x82, 0xFF, 0x9C, 0x00, 0xCC},
+	)
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Errorf("cluster\n% X\nwant\n% X", out.Bytes(), want)
+	}
+}
+
+// webmBlock is a SimpleBlock read back from a file, with its absolute time.
+type webmBlock struct {
+	track    uint64
+	keyframe bool
+	time     int64
+	data     string
+}
+
+// webmFile is what readWebM finds in a file.
+type webmFile struct {
+	docType  string
+	tracks   []webmTrack
+	clusters []int64
+	blocks   []webmBlock
+}
+
+func TestWebMWriterRoundTrip(t *testing.T) {
+	tracks := []webmTrack{
+		{Number: mixedVideoTrack, Video: true, CodecID: "V_VP8", Width: 640, Height: 480},
+		{Number: mixedAudioTrack, CodecID: "A_OPUS", CodecPrivate: opusHead(2, 48000), SampleRate: 48000, Channels: 2},
+	}
+	writes := []webmBlock{
+		{mixedVideoTrack, true, 0, "v0"},
+		{mixedAudioTrack, false, 20, "a20"},
+		{mixedVideoTrack, false, 500, "v500"},
+		// Too soon after the cluster started to open another.
+		{mixedVideoTrack, true, 900, "v900"},
+		{mixedVideoTrack, true, 1200, "v1200"},
+		// Late audio stays in the cluster, before its timecode.
+		{mixedAudioTrack, false, 1100, "a1100"},
+		// Five seconds without a keyframe closes the cluster anyway.
+		{mixedAudioTrack, false, 6300, "a6300"},
+		{mixedVideoTrack, false, 6400, "v6400"},
+		{mixedVideoTrack, true, 40000, "v40000"},
+		// Too far behind the cluster for an int16 offset.
+		{mixedAudioTrack, false, 7000, "a7000"},
+	}
+
+	var out bufferCloser
+	ww, err := newWebMWriter(&out, tracks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range writes {
+		if err := ww.WriteBlock(b.track, b.keyframe, b.time, []byte(b.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ww.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := readWebM(out.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.docType != "webm" {
+		t.Errorf("DocType %q, want webm", f.docType)
+	}
+	if len(f.tracks) != len(tracks) {
+		t.Fatalf("%d track entries, want %d", len(f.tracks), len(tracks))
+	}
+	for i, want := range tracks {
+		got := f.tracks[i]
+		if got.Number != want.Number || got.Video != want.Video || got.CodecID != want.CodecID ||
+			!bytes.Equal(got.CodecPrivate, want.CodecPrivate) {
+			t.Errorf("track %d = %+v, want %+v", i, got, want)
+		}
+	}
+	if want := []int64{0, 1200, 6300, 40000, 7000}; fmt.Sprint(f.clusters) != fmt.Sprint(want) {
+		t.Errorf("cluster timecodes %v, want %v", f.clusters, want)
+	}
+	if fmt.Sprint(f.blocks) != fmt.Sprint(writes) {
+		t.Errorf("blocks\n%v\nwant\n%v", f.blocks, writes)
+	}
+}
+
+// readWebM parses the elements webmWriter writes.
+func readWebM(b []byte) (*webmFile, error) {
+	f := &webmFile{}
+	var clusterTime int64
+	var track *webmTrack
+
+	var walk func(b []byte) error
+	walk = func(b []byte) error {
+		for len(b) > 0 {
+			id, payload, rest, err := readElement(b)
+			if err != nil {
+				return err
+			}
+			b = rest
+			switch id {
+			case idEBML, idSegment, idTracks, idCluster:
+				if err := walk(payload); err != nil {
+					return err
+				}
+			case idDocType:
+				f.docType = string(payload)
+			case idTrackEntry:
+				f.tracks = append(f.tracks, webmTrack{})
+				track = &f.tracks[len(f.tracks)-1]
+				if err := walk(payload); err != nil {
+					return err
+				}
+			case idTrackNumber:
+				track.Number = readUint(payload)
+			case idTrackType:
+				track.Video = readUint(payload) == 1
+			case idCodecID:
+				track.CodecID = string(payload)
+			case idCodecPrivate:
+				track.CodecPrivate = payload
+			case idTimecode:
+				clusterTime = int64(readUint(payload))
+				f.clusters = append(f.clusters, clusterTime)
+			case idSimpleBlock:
+				trackNumber, n, err := readVint(payload)
+				if err != nil {
+					return err
+				}
+				if len(payload) < n+3 {
+					return errors.New("short SimpleBlock")
+				}
+				relative := int16(binary.BigEndian.Uint16(payload[n:]))
+				f.blocks = append(f.blocks, webmBlock{
+					track:    trackNumber,
+					keyframe: payload[n+2]&0x80 != 0,
+					time:     clusterTime + int64(relative),
+					data:     string(payload[n+3:]),
+				})
+			}
+		}
+		return nil
+	}
+	if err := walk(b); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// readElement splits the first element off b. An element of unknown size
+// runs to the end of b.
+func readElement(b []byte) (id uint32, payload, rest []byte, err error) {
+	if len(b) == 0 || b[0] == 0 {
+		return 0, nil, nil, io.ErrUnexpectedEOF
+	}
+	idLen := 1
+	for b[0]&(0x80>>(idLen-1)) == 0 {
+		idLen++
+	}
+	if idLen > 4 || len(b) < idLen {
+		return 0, nil, nil, fmt.Errorf("bad element ID % X", b[:min(len(b), 4)])
+	}
+	for _, c := range b[:idLen] {
+		id = id<<8 | uint32(c)
+	}
+	b = b[idLen:]
+
+	v, n, err := readVint(b)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	b = b[n:]
+	if v == 1<<(7*n)-1 {
+		return id, b, nil, nil
+	}
+	if uint64(len(b)) < v {
+		return 0, nil, nil, fmt.Errorf("element %#x: %d bytes, want %d", id, len(b), v)
+	}
+	return id, b[:v], b[v:], nil
+}
+
+// readVint decodes a variable-length integer and returns its length.
+func readVint(b []byte) (uint64, int, error) {
+	if len(b) == 0 || b[0] == 0 {
+		return 0, 0, io.ErrUnexpectedEOF
+	}
+	n := 1
+	for b[0]&(0x80>>(n-1)) == 0 {
+		n++
+	}
+	if len(b) < n {
+		return 0, 0, io.ErrUnexpectedEOF
+	}
+	v := uint64(b[0] & (0xFF >> n))
+	for _, c := range b[1:n] {
+		v = v<<8 | uint64(c)
+	}
+	return v, n, nil
+}
+
+func readUint(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// HandleWHEP creates a viewer from a WHEP offer posted to /whep/{room}. The
+// client is egress-only: it receives the room's switched output, following
+// the active speaker, or the participant named by the source query
+// parameter. Any role may view. Like WHIP, the answer carries every server
+// candidate and the Location header names the session's resource.
+func (s *Server) HandleWHEP(w http.ResponseWriter, r *http.Request) {
+	if !hasContentType(r, "application/sdp") {
+		http.Error(w, "offer must be application/sdp", http.StatusUnsupportedMediaType)
+		return
+	}
+	source := 0
+	if v := r.URL.Query().Get("source"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil || id <= 0 {
+			http.Error(w, "invalid source", http.StatusBadRequest)
+			return
+		}
+		source = id
+	}
+	roomID := r.PathValue("room")
+	claims, err := s.authorize(r, roomID)
+	if err != nil {
+		log.Println("Unauthorized WHEP request:", err)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	offer, err := io.ReadAll(io.LimitReader(r.Body, whipMaxBody))
+	if err != nil {
+		http.Error(w, "cannot read offer", http.StatusBadRequest)
+		return
+	}
+
+	client := &Client{
+		Name:   claims.Name,
+		Role:   claims.Role,
+		Egress: true,
+	}
+	client.readyChan = make(chan struct{})
+
+	room, err := s.joinRoom(claims.Room, client)
+	if err != nil {
+		log.Printf("WHEP client rejected from room %q: %v\n", claims.Room, err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	pc, err := NewPeer(client, room)
+	if err != nil {
+		s.leaveRoom(room, client.ID)
+		http.Error(w, "cannot create peer connection", http.StatusInternalServerError)
+		return
+	}
+	id, err := newToken()
+	if err != nil {
+		pc.Close()
+		s.leaveRoom(room, client.ID)
+		http.Error(w, "cannot create resource", http.StatusInternalServerError)
+		return
+	}
+
+	s.mu.Lock()
+	s.resources[id] = client
+	s.mu.Unlock()
+	room.Attach(client, pc)
+
+	if source != 0 {
+		err := room.SelectSource(client, source, "")
+		switch {
+		case errors.Is(err, errIncompatibleCodec):
+			s.endResource(id)
+			http.Error(w, err.Error(), http.StatusNotAcceptable)
+			return
+		case err != nil:
+			s.endResource(id)
+			http.Error(w, fmt.Sprintf("participant %d is not publishing", source), http.StatusNotFound)
+			return
+		}
+	}
+
+	pc.OnConnectionStateChange(func(pcs webrtc.PeerConnectionState) {
+		fmt.Println("peer connection state changed:", pcs)
+		if pcs == webrtc.PeerConnectionStateFailed {
+			go s.endResource(id)
+		}
+	})
+
+	if err := client.checkOutputs(string(offer)); err != nil {
+		s.endResource(id)
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+	answer, err := answerOffer(pc, string(offer))
+	if err != nil {
+		log.Printf("WHEP offer from client %d failed: %v\n", client.ID, err)
+		s.endResource(id)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("WHEP client %d (%q) viewing room %q\n", client.ID, client.Name, room.ID)
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", "/whep/"+url.PathEscape(room.ID)+"/"+id)
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, answer)
+}
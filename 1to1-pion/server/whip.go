@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	// whipMaxBody caps the size of a WHIP or WHEP offer or fragment.
+	whipMaxBody = 64 << 10
+
+	// whipGatherTimeout bounds how long an answer waits for the server's
+	// ICE candidates, which it carries since the server does not trickle.
+	whipGatherTimeout = 5 * time.Second
+)
+
+var errICERestart = errors.New("ICE restarts are not supported")
+
+// HandleWHIP creates a publisher from a WHIP offer posted to /whip/{room}.
+// The client is ingest-only: its tracks are forwarded like those of any
+// publisher, but nothing is sent to it. The answer carries every server
+// candidate, and the Location header names the resource that takes trickled
+// candidates and ends the session.
+func (s *Server) HandleWHIP(w http.ResponseWriter, r *http.Request) {
+	if !hasContentType(r, "application/sdp") {
+		http.Error(w, "offer must be application/sdp", http.StatusUnsupportedMediaType)
+		return
+	}
+	roomID := r.PathValue("room")
+	claims, err := s.authorize(r, roomID)
+	if err != nil {
+		log.Println("Unauthorized WHIP request:", err)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !claims.Role.CanPublish() {
+		http.Error(w, "token does not allow publishing", http.StatusForbidden)
+		return
+	}
+	offer, err := io.ReadAll(io.LimitReader(r.Body, whipMaxBody))
+	if err != nil {
+		http.Error(w, "cannot read offer", http.StatusBadRequest)
+		return
+	}
+
+	client := &Client{
+		Name:   claims.Name,
+		Role:   claims.Role,
+		Ingest: true,
+	}
+	client.readyChan = make(chan struct{})
+
+	room, err := s.joinRoom(claims.Room, client)
+	if err != nil {
+		log.Printf("WHIP client rejected from room %q: %v\n", claims.Room, err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	pc, err := NewIngestPeer(client, room)
+	if err != nil {
+		s.leaveRoom(room, client.ID)
+		http.Error(w, "cannot create peer connection", http.StatusInternalServerError)
+		return
+	}
+	id, err := newToken()
+	if err != nil {
+		pc.Close()
+		s.leaveRoom(room, client.ID)
+		http.Error(w, "cannot create resource", http.StatusInternalServerError)
+		return
+	}
+
+	s.mu.Lock()
+	s.resources[id] = client
+	s.mu.Unlock()
+	room.Attach(client, pc)
+
+	pc.OnConnectionStateChange(func(pcs webrtc.PeerConnectionState) {
+		fmt.Println("peer connection state changed:", pcs)
+		if pcs == webrtc.PeerConnectionStateFailed {
+			go s.endResource(id)
+		}
+	})
+
+	answer, err := answerOffer(pc, string(offer))
+	if err != nil {
+		log.Printf("WHIP offer from client %d failed: %v\n", client.ID, err)
+		s.endResource(id)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("WHIP client %d (%q) publishing to room %q\n", client.ID, client.Name, room.ID)
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", "/whip/"+url.PathEscape(room.ID)+"/"+id)
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, answer)
+}
+
+// HandleResourcePatch adds the candidates of a trickle ICE fragment patched
+// to a WHIP or WHEP resource.
+func (s *Server) HandleResourcePatch(w http.ResponseWriter, r *http.Request) {
+	client := s.resourceClient(r)
+	if client == nil {
+		http.Error(w, "unknown resource", http.StatusNotFound)
+		return
+	}
+	if !hasContentType(r, "application/trickle-ice-sdpfrag") {
+		http.Error(w, "fragment must be application/trickle-ice-sdpfrag", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	err := addTrickleCandidates(client.PC, io.LimitReader(r.Body, whipMaxBody))
+	switch {
+	case errors.Is(err, errICERestart):
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// HandleResourceDelete ends a WHIP or WHEP session.
+func (s *Server) HandleResourceDelete(w http.ResponseWriter, r *http.Request) {
+	if s.resourceClient(r) == nil || !s.endResource(r.PathValue("id")) {
+		http.Error(w, "unknown resource", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// resourceClient returns the client of the WHIP or WHEP resource in the
+// request path, or nil.
+func (s *Server) resourceClient(r *http.Request) *Client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.resources[r.PathValue("id")]
+	if c == nil || c.Room.ID != r.PathValue("room") {
+		return nil
+	}
+	if c.Egress != strings.HasPrefix(r.URL.Path, "/whep/") {
+		return nil
+	}
+	return c
+}
+
+// resourceID returns the ID of the client's WHIP or WHEP resource, or "".
+func (s *Server) resourceID(c *Client) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, candidate := range s.resources {
+		if candidate == c {
+			return id
+		}
+	}
+	return ""
+}
+
+// endResource closes a WHIP or WHEP session and removes its client from the
+// room. It reports whether the session was still open.
+func (s *Server) endResource(id string) bool {
+	s.mu.Lock()
+	c, ok := s.resources[id]
+	delete(s.resources, id)
+	s.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	protocol := "WHIP"
+	if c.Egress {
+		protocol = "WHEP"
+	}
+	log.Printf("%s client %d disconnected from room %q\n", protocol, c.ID, c.Room.ID)
+	c.closePeer()
+	s.leaveRoom(c.Room, c.ID)
+	c.Close()
+	return true
+}
+
+// answerOffer answers a WHIP or WHEP offer once the server's candidates are
+// gathered.
+func answerOffer(pc *webrtc.PeerConnection, offer string) (string, error) {
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  offer,
+	}); err != nil {
+		return "", err
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return "", err
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		return "", err
+	}
+
+	select {
+	case <-gathered:
+	case <-time.After(whipGatherTimeout):
+		log.Println("Answer sent before ICE gathering completed")
+	}
+	return pc.LocalDescription().SDP, nil
+}
+
+// addTrickleCandidates adds the candidates of a trickle ICE SDP fragment. A
+// fragment with ICE credentials other than the offer's asks for an ICE
+// restart.
+func addTrickleCandidates(pc *webrtc.PeerConnection, frag io.Reader) error {
+	remoteUfrag := sdpAttribute(pc.RemoteDescription().SDP, "ice-ufrag")
+
+	var mid *string
+	scanner := bufio.NewScanner(frag)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			if ufrag := strings.TrimPrefix(line, "a=ice-ufrag:"); ufrag != remoteUfrag {
+				return errICERestart
+			}
+		case strings.HasPrefix(line, "a=mid:"):
+			m := strings.TrimPrefix(line, "a=mid:")
+			mid = &m
+		case strings.HasPrefix(line, "a=candidate:"):
+			if err := pc.AddICECandidate(webrtc.ICECandidateInit{
+				Candidate: strings.TrimPrefix(line, "a="),
+				SDPMid:    mid,
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// sdpAttribute returns the value of the first a=<name>: line of an SDP.
+func sdpAttribute(sdp, name string) string {
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		if value, ok := strings.CutPrefix(line, "a="+name+":"); ok {
+			return value
+		}
+	}
+	return ""
+}
+
+func hasContentType(r *http.Request, want string) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == want
+}